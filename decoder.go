@@ -0,0 +1,628 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+/*
+ * Decodes parsed UCL into Go values
+ */
+package ucl
+
+import (
+	"encoding"
+	"fmt"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Decode flags
+const (
+	// Fail with an UnknownKeysError if the input has keys that no struct
+	// field decodes
+	DisallowUnknownKeys = 1 << iota
+)
+
+// Converts v, a value parsed as type from, for decoding into type to, e.g.
+// a comma-separated string into a list. A hook returns v unchanged if it
+// does not apply.
+type DecodeHook func(from, to reflect.Type, v interface{}) (interface{}, error)
+
+type decoder struct {
+	tag     string
+	flags   int
+	hooks   []DecodeHook
+	unknown []*UnknownKey
+	invalid ValidationErrors
+}
+
+// A key of the input that no struct field decodes, e.g. a misspelt one
+type UnknownKey struct {
+	Path   string
+	Origin *Origin // where the key was set, when known
+}
+
+func (k *UnknownKey) Error() string {
+	return "unknown key " + k.Path + k.Origin.at()
+}
+
+// All the unknown keys, when decoding with DisallowUnknownKeys
+type UnknownKeysError []*UnknownKey
+
+func (e UnknownKeysError) Error() string {
+	msgs := make([]string, len(e))
+	for i, k := range e {
+		msgs[i] = k.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// A struct field to decode into, with its key and tag options
+type field struct {
+	name  string
+	t     reflect.Type
+	index []int         // as for reflect.Value.FieldByIndex
+	v     reflect.Value // invalid while behind a nil embedded pointer
+	opts  tagOptions
+	usage string
+	rules string // from the validate tag
+}
+
+// Decode the parsed UCL in m (as returned by Parser.Ucl) into v, which must
+// be a non-nil pointer.
+// tag = if v has struct components, then use tag to search for the tag's key
+func Decode(m map[string] interface{}, v interface{}, tag string) error {
+	_, err := decodeFlags(nil, m, v, tag, 0, nil)
+	return err
+}
+
+// Decode as Decode does, and return the keys that no struct field decodes as
+// warnings; with DisallowUnknownKeys, they are an UnknownKeysError instead.
+// Each value is passed through hooks, in order, before being decoded.
+func DecodeFlags(m map[string] interface{}, v interface{}, tag string,
+                 flags int, hooks ...DecodeHook) ([]*UnknownKey, error) {
+	return decodeFlags(nil, m, v, tag, flags, hooks)
+}
+
+// Decode the parsed result into v, as DecodeFlags does, with the line each
+// unknown key was set at.
+func (p *Parser) Decode(v interface{}, tag string, flags int,
+                        hooks ...DecodeHook) ([]*UnknownKey, error) {
+	return decodeFlags(p, p.ucl, v, tag, flags, hooks)
+}
+
+func decodeFlags(p *Parser, m map[string] interface{}, v interface{},
+                 tag string, flags int,
+                 hooks []DecodeHook) ([]*UnknownKey, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return nil, fmt.Errorf("cannot decode into non-pointer %T", v)
+	}
+
+	d := &decoder{tag: tag, flags: flags, hooks: hooks}
+	if err := d.decode(m, rv.Elem(), ""); err != nil {
+		return nil, err
+	}
+	if p != nil {
+		for _, k := range d.unknown {
+			if o, ok := p.Origin(k.Path); ok {
+				k.Origin = &o
+			}
+		}
+		for _, e := range d.invalid {
+			if o, ok := p.Origin(e.where); ok {
+				e.Origin = &o
+			}
+		}
+	}
+	if flags & DisallowUnknownKeys != 0 && len(d.unknown) > 0 {
+		return nil, UnknownKeysError(d.unknown)
+	}
+	if len(d.invalid) > 0 {
+		return d.unknown, d.invalid
+	}
+	return d.unknown, nil
+}
+
+// Key path of a child of path, e.g. "section.foo"
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func (d *decoder) typeError(in interface{}, v reflect.Value, path string) error {
+	if path == "" {
+		path = "<root>"
+	}
+	return fmt.Errorf("%s: cannot decode %T into %s", path, in, v.Type())
+}
+
+var (
+	regexType     = reflect.TypeOf(Regex{})
+	regexpType    = reflect.TypeOf(regexp.Regexp{})
+	regexpPtrType = reflect.TypeOf((*regexp.Regexp)(nil))
+)
+
+func (d *decoder) decode(in interface{}, v reflect.Value, path string) error {
+	if in == nil {
+		// null value
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+
+	if len(d.hooks) > 0 {
+		from := reflect.TypeOf(in)
+		var err error
+		if in, err = d.runHooks(in, v, path); err != nil {
+			return err
+		}
+		if in == nil {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		if iv := reflect.ValueOf(in); iv.Type() != from &&
+		   iv.Type().AssignableTo(v.Type()) {
+			// converted by a hook to the type itself, e.g. an enum
+			v.Set(iv)
+			return nil
+		}
+	}
+
+	switch v.Type() {
+	case regexType, regexpType, regexpPtrType:
+		return d.decodeRegex(in, v, path)
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decode(in, v.Elem(), path)
+	case reflect.Interface:
+		if r := registryOf(v.Type()); r != nil {
+			if m, ok := in.(map[string] interface{}); ok {
+				return d.decodeRegistered(r, m, v, path)
+			}
+		}
+		iv := reflect.ValueOf(in)
+		if !iv.Type().AssignableTo(v.Type()) {
+			return d.typeError(in, v, path)
+		}
+		v.Set(iv)
+		return nil
+	case reflect.Struct:
+		return d.decodeStruct(in, v, path)
+	case reflect.Map:
+		return d.decodeMap(in, v, path)
+	case reflect.Slice, reflect.Array:
+		return d.decodeSlice(in, v, path)
+	default:
+		return d.decodeScalar(in, v, path)
+	}
+}
+
+// Pass in through the hooks, for decoding into v
+func (d *decoder) runHooks(in interface{}, v reflect.Value,
+                           path string) (interface{}, error) {
+	for _, hook := range d.hooks {
+		if in == nil {
+			break
+		}
+		var err error
+		if in, err = hook(reflect.TypeOf(in), v.Type(), in); err != nil {
+			if path == "" {
+				path = "<root>"
+			}
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	return in, nil
+}
+
+// Find the key of m that holds the value for key; exact matches are
+// preferred over case-insensitive ones.
+func lookupKey(m map[string] interface{}, key string) (string, bool) {
+	if _, ok := m[key]; ok {
+		return key, true
+	}
+	for k := range m {
+		if k != KeyOrder && strings.EqualFold(k, key) {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+// Gather the fields of struct v that can be decoded into, drilling into
+// embedded and inline structs. Nil embedded pointers are left for alloc to
+// fill in, should one of their fields be set.
+func (d *decoder) structFields(v reflect.Value) []field {
+	return d.structFieldsOf(v.Type(), v, nil, make(map[reflect.Type] bool))
+}
+
+// Gather the fields of struct type t, whose value v is invalid if behind a
+// nil embedded pointer, at index within the outermost struct; embedded
+// holds the types being flattened, so that a struct embedding itself
+// through a pointer is not recursed into
+func (d *decoder) structFieldsOf(t reflect.Type, v reflect.Value, index []int,
+                                 embedded map[reflect.Type] bool) []field {
+	fields := make([]field, 0, t.NumField())
+	embedded[t] = true
+	defer delete(embedded, t)
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		var cv reflect.Value
+		if v.IsValid() {
+			cv = v.Field(i)
+		}
+		cindex := append(index[:len(index):len(index)], i)
+
+		name, opts := parseTag(sf.Tag.Get(d.tag))
+		if name == "-" && opts == "" {
+			continue
+		}
+
+		if (sf.Anonymous && name == "") || opts.Contains("inline") {
+			ft := sf.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				if embedded[ft] {
+					continue
+				}
+				if sf.Type.Kind() == reflect.Ptr {
+					if !cv.IsValid() || cv.IsNil() {
+						if sf.PkgPath != "" {
+							// unexported, so cannot be allocated
+							continue
+						}
+						cv = reflect.Value{}
+					} else {
+						cv = cv.Elem()
+					}
+				}
+				fields = append(fields,
+				                d.structFieldsOf(ft, cv, cindex, embedded)...)
+				continue
+			}
+		}
+
+		if sf.PkgPath != "" {
+			// unexported
+			continue
+		}
+		if name == "" {
+			name = sf.Name
+		}
+		fields = append(fields, field{
+			name: name,
+			t: sf.Type,
+			index: cindex,
+			v: cv,
+			opts: opts,
+			usage: sf.Tag.Get("usage"),
+			rules: sf.Tag.Get("validate"),
+		})
+	}
+	return fields
+}
+
+// The field f of struct v, allocating the embedded pointers on the way
+func (f *field) alloc(v reflect.Value) reflect.Value {
+	if f.v.IsValid() {
+		return f.v
+	}
+	for i, x := range f.index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v
+}
+
+func (d *decoder) decodeStruct(in interface{}, v reflect.Value, path string) error {
+	m, ok := in.(map[string] interface{})
+	if !ok {
+		return d.typeError(in, v, path)
+	}
+
+	fields := d.structFields(v)
+	used := make(map[string] bool, len(fields))
+	for i := range fields {
+		fpath := joinPath(path, fields[i].name)
+		var val interface{}
+		k, ok := lookupKey(m, fields[i].name)
+		if ok {
+			val = m[k]
+			used[k] = true
+		} else if def, ok := fields[i].opts.Get("default"); ok {
+			val = def
+		} else {
+			// a missing key is reported where its object was set
+			err := d.validate(fields[i], fields[i].v, false, fpath, path)
+			if err != nil {
+				return err
+			}
+			if err := d.validateAbsent(fields[i].v, fpath, path); err != nil {
+				return err
+			}
+			continue
+		}
+		fv := fields[i].alloc(v)
+		if err := d.decode(val, fv, fpath); err != nil {
+			return err
+		}
+		where := path
+		if ok {
+			where = joinPath(path, k)
+		}
+		if err := d.validate(fields[i], fv, true, fpath, where); err != nil {
+			return err
+		}
+	}
+
+	var unknown []string
+	for k := range m {
+		if k != KeyOrder && !used[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+	for _, k := range unknown {
+		d.unknown = append(d.unknown, &UnknownKey{Path: joinPath(path, k)})
+	}
+	return nil
+}
+
+func (d *decoder) decodeMap(in interface{}, v reflect.Value, path string) error {
+	m, ok := in.(map[string] interface{})
+	if !ok {
+		return d.typeError(in, v, path)
+	}
+	if v.IsNil() {
+		v.Set(reflect.MakeMapWithSize(v.Type(), len(m)))
+	}
+	et := v.Type().Elem()
+	for k, val := range m {
+		if k == KeyOrder {
+			continue
+		}
+		kv, err := d.mapKey(k, v.Type().Key(), path)
+		if err != nil {
+			return err
+		}
+		ev := reflect.New(et).Elem()
+		if err := d.decode(val, ev, joinPath(path, k)); err != nil {
+			return err
+		}
+		v.SetMapIndex(kv, ev)
+	}
+	return nil
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// Convert key k to a map key of type kt
+func (d *decoder) mapKey(k string, kt reflect.Type, path string) (reflect.Value, error) {
+	if reflect.PtrTo(kt).Implements(textUnmarshalerType) {
+		kv := reflect.New(kt)
+		err := kv.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(k))
+		if err != nil {
+			return kv, fmt.Errorf("%s: invalid key %q: %v", path, k, err)
+		}
+		return kv.Elem(), nil
+	}
+
+	kv := reflect.New(kt).Elem()
+	var err error
+	switch kt.Kind() {
+	case reflect.String:
+		kv.SetString(k)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		if n, err = strconv.ParseInt(k, 10, kt.Bits()); err == nil {
+			kv.SetInt(n)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+	     reflect.Uint64, reflect.Uintptr:
+		var n uint64
+		if n, err = strconv.ParseUint(k, 10, kt.Bits()); err == nil {
+			kv.SetUint(n)
+		}
+	case reflect.Bool:
+		var b bool
+		if b, err = parseBool(k); err == nil {
+			kv.SetBool(b)
+		}
+	default:
+		return kv, fmt.Errorf("%s: %s %s", path, kt,
+		                      "cannot be used as a map key")
+	}
+	if err != nil {
+		return kv, fmt.Errorf("%s: invalid %s key %q", path, kt, k)
+	}
+	return kv, nil
+}
+
+func (d *decoder) decodeSlice(in interface{}, v reflect.Value, path string) error {
+	list, ok := in.([]interface{})
+	if !ok {
+		// a key given only once is a single element array
+		list = []interface{}{in}
+	}
+
+	if v.Kind() == reflect.Array {
+		if len(list) > v.Len() {
+			return fmt.Errorf("%s: %d elements do not fit in %s", path,
+			                  len(list), v.Type())
+		}
+	} else {
+		v.Set(reflect.MakeSlice(v.Type(), len(list), len(list)))
+	}
+
+	for i := range list {
+		err := d.decode(list[i], v.Index(i), fmt.Sprintf("%s[%d]", path, i))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Decode into a Regex or regexp.Regexp, from a Regex or a string holding
+// the pattern
+func (d *decoder) decodeRegex(in interface{}, v reflect.Value, path string) error {
+	var r Regex
+	switch x := in.(type) {
+	case Regex:
+		r = x
+	case string:
+		r.Source = x
+	case Number:
+		r.Source = string(x)
+	default:
+		return d.typeError(in, v, path)
+	}
+
+	if v.Type() == regexType {
+		v.Set(reflect.ValueOf(r))
+		return nil
+	}
+	re, err := r.Compile()
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if v.Type() == regexpPtrType {
+		v.Set(reflect.ValueOf(re))
+	} else {
+		v.Set(reflect.ValueOf(re).Elem())
+	}
+	return nil
+}
+
+// Booleans as accepted by libucl
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "true", "yes", "on":
+		return true, nil
+	case "false", "no", "off":
+		return false, nil
+	}
+	return strconv.ParseBool(s)
+}
+
+func (d *decoder) decodeScalar(in interface{}, v reflect.Value, path string) error {
+	// typed values are converted from their text form, which is exact.
+	// Only Number can hold the Go forms of numbers, as the parser must
+	// have been asked to accept them.
+	var s string
+	goforms := false
+	switch n := in.(type) {
+	case string:
+		s = n
+	case Number:
+		s = string(n)
+		goforms = true
+	case int64:
+		s = strconv.FormatInt(n, 10)
+	case uint64:
+		s = strconv.FormatUint(n, 10)
+	case float64:
+		s = formatFloat(n, 64)
+	case Regex:
+		s = n.String()
+	default:
+		return d.typeError(in, v, path)
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+
+	case reflect.Bool:
+		b, err := parseBool(s)
+		if err != nil {
+			return fmt.Errorf("%s: invalid boolean %q", path, s)
+		}
+		v.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, _, _ := parseNumber(s, goforms)
+		i, ok := n.(int64)
+		if !ok || v.OverflowInt(i) {
+			return fmt.Errorf("%s: invalid %s %q", path, v.Type(), s)
+		}
+		v.SetInt(i)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+	     reflect.Uint64, reflect.Uintptr:
+		var u uint64
+		ok := false
+		switch n, _, _ := parseNumber(s, goforms); n := n.(type) {
+		case int64:
+			u, ok = uint64(n), n >= 0
+		case uint64:
+			u, ok = n, true
+		}
+		if !ok || v.OverflowUint(u) {
+			return fmt.Errorf("%s: invalid %s %q", path, v.Type(), s)
+		}
+		v.SetUint(u)
+
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		ok := true
+		switch n, _, _ := parseNumber(s, goforms); n := n.(type) {
+		case int64:
+			f = float64(n)
+		case uint64:
+			f = float64(n)
+		case float64:
+			f = n
+		default:
+			ok = false
+		}
+		if !ok || v.OverflowFloat(f) {
+			return fmt.Errorf("%s: invalid %s %q", path, v.Type(), s)
+		}
+		v.SetFloat(f)
+
+	default:
+		return d.typeError(in, v, path)
+	}
+	return nil
+}
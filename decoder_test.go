@@ -0,0 +1,412 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"testing"
+	"bytes"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+func parseString(t *testing.T, s string) map[string] interface{} {
+	p := NewParser(bytes.NewBufferString(s))
+	ucl, err := p.Ucl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ucl
+}
+
+func TestDecode(t *testing.T) {
+	type backend struct {
+		Host string `ucl:"host"`
+		Port int    `ucl:"port"`
+	}
+	var cfg struct {
+		Name    string             `ucl:"name"`
+		Debug   bool               `ucl:"debug"`
+		Ratio   float64            `ucl:"ratio"`
+		Max     uint16             `ucl:"max"`
+		Tags    []string           `ucl:"tags"`
+		Backend []backend          `ucl:"backend"`
+		Extra   map[string] string `ucl:"extra"`
+		Any     interface{}        `ucl:"any"`
+		Ptr     *backend           `ucl:"ptr"`
+		Untagged string
+	}
+
+	ucl := parseString(t, `
+name test;
+debug yes;
+ratio 0.5;
+max 65535;
+tags [ a, b ];
+backend { host a; port 80; }
+extra { x y; }
+any foo;
+ptr { host p; port 1; }
+untagged u;
+`)
+	if err := Decode(ucl, &cfg, "ucl"); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Name != "test" || !cfg.Debug || cfg.Ratio != 0.5 ||
+	   cfg.Max != 65535 || cfg.Any != "foo" || cfg.Untagged != "u" {
+		t.Fatalf("unexpected result: %+v", cfg)
+	}
+	if !reflect.DeepEqual(cfg.Tags, []string{"a", "b"}) ||
+	   !reflect.DeepEqual(cfg.Backend, []backend{{"a", 80}}) ||
+	   !reflect.DeepEqual(cfg.Extra, map[string] string{"x": "y"}) ||
+	   cfg.Ptr == nil || *cfg.Ptr != (backend{"p", 1}) {
+		t.Fatalf("unexpected result: %+v", cfg)
+	}
+
+	err := Decode(parseString(t, "backend { port eighty; }"), &cfg, "ucl")
+	if err == nil || err.Error() != `backend[0].port: invalid int "eighty"` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestTagOptions(t *testing.T) {
+	type common struct {
+		Level int `ucl:"level"`
+	}
+	type opts struct {
+		Common  common  `ucl:",inline"`
+		Name    string  `ucl:"name,omitempty"`
+		Port    int     `ucl:"port,omitempty,default=80"`
+		Timeout float64 `ucl:"timeout,string"`
+		Count   int     `ucl:"count,default=3"`
+	}
+
+	in := opts{Common: common{2}, Port: 80, Timeout: 1.5, Count: 3}
+	var buf bytes.Buffer
+	if err := Encode(&buf, &in, "", "ucl", ""); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != `level 2;timeout "1.5";count 3;` {
+		t.Fatalf("unexpected output: %s", buf.String())
+	}
+
+	var out opts
+	if err := Decode(parseString(t, buf.String()), &out, "ucl"); err != nil {
+		t.Fatal(err)
+	}
+	if out != in {
+		t.Fatalf("round trip mismatch: %+v vs %+v", out, in)
+	}
+
+	// zero is not the default, so it must be written out
+	in.Port = 0
+	buf.Reset()
+	Encode(&buf, &in, "", "ucl", "")
+	out = opts{}
+	if err := Decode(parseString(t, buf.String()), &out, "ucl"); err != nil {
+		t.Fatal(err)
+	}
+	if out != in {
+		t.Fatalf("round trip mismatch: %+v vs %+v", out, in)
+	}
+}
+
+// key type with a text form of "id-N"
+type testID int
+
+func (id testID) MarshalText() ([]byte, error) {
+	return []byte(fmt.Sprintf("id-%d", int(id))), nil
+}
+
+func (id *testID) UnmarshalText(b []byte) error {
+	var n int
+	if _, err := fmt.Sscanf(string(b), "id-%d", &n); err != nil {
+		return err
+	}
+	*id = testID(n)
+	return nil
+}
+
+func TestMapKeys(t *testing.T) {
+	type backend struct {
+		Host string `ucl:"host"`
+	}
+	type maps struct {
+		Ints  map[int] backend    `ucl:"ints"`
+		Uints map[uint8] string   `ucl:"uints"`
+		Bools map[bool] string    `ucl:"bools"`
+		IDs   map[testID] backend `ucl:"ids"`
+	}
+	in := maps{
+		Ints:  map[int] backend{-1: {"a"}, 10: {"b"}},
+		Uints: map[uint8] string{255: "max"},
+		Bools: map[bool] string{true: "yes", false: "no"},
+		IDs:   map[testID] backend{7: {"c"}},
+	}
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, &in, "", "ucl", ""); err != nil {
+		t.Fatal(err)
+	}
+	expect := `ints {-1 {host a;};10 {host b;};};uints {255 max;};` +
+	          `bools {false no;true yes;};ids {id-7 {host c;};};`
+	if buf.String() != expect {
+		t.Fatalf("unexpected output: %s", buf.String())
+	}
+
+	var out maps
+	if err := Decode(parseString(t, buf.String()), &out, "ucl"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Fatalf("round trip mismatch: %+v vs %+v", out, in)
+	}
+
+	err := Decode(parseString(t, "ints { x { host a; } }"), &out, "ucl")
+	if err == nil || err.Error() != `ints: invalid int key "x"` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err = Encode(&buf, map[float64] int{1: 1}, "", "ucl", ""); err == nil {
+		t.Fatal("float key did not fail")
+	}
+}
+
+func TestUnknownKeys(t *testing.T) {
+	type listener struct {
+		Listen int    `ucl:"listen"`
+		Name   string `ucl:"name"`
+	}
+	type config struct {
+		Servers []listener             `ucl:"servers"`
+		Extra   map[string] interface{} `ucl:"extra"`
+	}
+	s := `
+servers {
+	listn = 80;
+	Name = a;
+}
+servers {
+	listen = 81;
+}
+extra {
+	anything = 1;
+}
+debug = true;
+`
+	p := NewParser(bytes.NewBufferString(s))
+	if _, err := p.Ucl(); err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg config
+	warnings, err := p.Decode(&cfg, "ucl", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []string
+	for _, w := range warnings {
+		msgs = append(msgs, w.Error())
+	}
+	expect := []string{"unknown key servers[0].listn at line 3",
+	                   "unknown key debug at line 12"}
+	if !reflect.DeepEqual(msgs, expect) {
+		t.Errorf("got warnings %q", msgs)
+	}
+	if cfg.Servers[0].Name != "a" || cfg.Servers[1].Listen != 81 {
+		t.Errorf("got %+v", cfg)
+	}
+
+	_, err = p.Decode(&cfg, "ucl", DisallowUnknownKeys)
+	if ke, ok := err.(UnknownKeysError); !ok || len(ke) != 2 ||
+	   err.Error() != strings.Join(expect, "; ") {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// a section given once decodes as a list of one, and keeps its line
+	var single struct {
+		Backend []listener `ucl:"backend"`
+	}
+	sp := NewParser(bytes.NewBufferString("\nbackend {\n\tlistn 80;\n}\n"))
+	if _, err := sp.Ucl(); err != nil {
+		t.Fatal(err)
+	}
+	warnings, err = sp.Decode(&single, "ucl", 0)
+	if err != nil || len(warnings) != 1 ||
+	   warnings[0].Error() != "unknown key backend[0].listn at line 3" {
+		t.Errorf("single section: got %v, %v", warnings, err)
+	}
+	if o, ok := sp.Origin("backend[1]"); ok {
+		t.Errorf("backend[1]: got %v", o)
+	}
+
+	warnings, err = DecodeFlags(p.ucl, &cfg, "ucl", 0)
+	if err != nil || len(warnings) != 2 || warnings[1].Origin != nil ||
+	   warnings[1].Error() != "unknown key debug" {
+		t.Errorf("got %v, %v", warnings, err)
+	}
+}
+
+type testColor int
+
+const (
+	testRed testColor = iota + 1
+	testGreen
+)
+
+func TestDecodeHooks(t *testing.T) {
+	type config struct {
+		Hosts   []string    `ucl:"hosts"`
+		Color   testColor   `ucl:"color"`
+		Size    int64       `ucl:"size"`
+		Colors  []testColor `ucl:"colors"`
+		Timeout *int        `ucl:"timeout"`
+	}
+	var calls []string
+
+	split := func(from, to reflect.Type, v interface{}) (interface{}, error) {
+		s, ok := v.(string)
+		if from.Kind() != reflect.String || to.Kind() != reflect.Slice || !ok {
+			return v, nil
+		}
+		var l []interface{}
+		for _, part := range strings.Split(s, ",") {
+			l = append(l, strings.TrimSpace(part))
+		}
+		return l, nil
+	}
+	color := func(from, to reflect.Type, v interface{}) (interface{}, error) {
+		if to != reflect.TypeOf(testColor(0)) {
+			return v, nil
+		}
+		switch v {
+		case "red":
+			return testRed, nil
+		case "green":
+			return testGreen, nil
+		}
+		return nil, fmt.Errorf("unknown color %v", v)
+	}
+	size := func(from, to reflect.Type, v interface{}) (interface{}, error) {
+		calls = append(calls, fmt.Sprintf("%v->%v", from, to))
+		s, ok := v.(string)
+		if !ok || to.Kind() != reflect.Int64 || !strings.HasSuffix(s, "K") {
+			return v, nil
+		}
+		n, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		return n * 1024, err
+	}
+
+	s := `
+hosts = "a, b,c";
+color = green;
+size = 10K;
+colors = "red,green";
+timeout = 5;
+`
+	p := NewParserFlags(bytes.NewBufferString(s), ParseNumbers)
+	if _, err := p.Ucl(); err != nil {
+		t.Fatal(err)
+	}
+	var cfg config
+	if _, err := p.Decode(&cfg, "ucl", 0, split, color, size); err != nil {
+		t.Fatal(err)
+	}
+	timeout := 5
+	expect := config{
+		Hosts: []string{"a", "b", "c"},
+		Color: testGreen,
+		Size: 10240,
+		Colors: []testColor{testRed, testGreen},
+		Timeout: &timeout,
+	}
+	if !reflect.DeepEqual(cfg, expect) {
+		t.Errorf("got %+v", cfg)
+	}
+	// later hooks see what earlier ones returned
+	if calls[0] != "map[string]interface {}->ucl.config" ||
+	   calls[1] != "[]interface {}->[]string" {
+		t.Errorf("hook calls: %v", calls)
+	}
+
+	_, err := DecodeFlags(parseString(t, "color = blue;"), &cfg, "ucl", 0, color)
+	if err == nil || err.Error() != "color: unknown color blue" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+type SelfEmbed struct {
+	*SelfEmbed
+	X int `json:"x"`
+}
+
+type EmbedInner struct {
+	Y int `json:"y"`
+}
+
+type EmbedOpt struct {
+	Z int `json:"z"`
+}
+
+func TestDecodeEmbedded(t *testing.T) {
+	type outer struct {
+		*EmbedInner
+		Opt *EmbedOpt `json:"opt,inline"`
+		X   int       `json:"x"`
+	}
+
+	// embedded pointers are only allocated when one of their keys is set
+	var o outer
+	if err := Decode(parseString(t, "x = 1;"), &o, "json"); err != nil {
+		t.Fatal(err)
+	}
+	if o.X != 1 || o.EmbedInner != nil || o.Opt != nil {
+		t.Errorf("got %+v", o)
+	}
+	if err := Decode(parseString(t, "y = 2;"), &o, "json"); err != nil {
+		t.Fatal(err)
+	}
+	if o.EmbedInner == nil || o.Y != 2 || o.Opt != nil {
+		t.Errorf("got %+v", o)
+	}
+
+	// a type embedding itself is not recursed into
+	var s SelfEmbed
+	if err := Decode(parseString(t, "x = 3;"), &s, "json"); err != nil {
+		t.Fatal(err)
+	}
+	if s.X != 3 || s.SelfEmbed != nil {
+		t.Errorf("got %+v", s)
+	}
+	_, err := DecodeFlags(parseString(t, "x = 3; z = 1;"), &s, "json",
+	                      DisallowUnknownKeys)
+	if err == nil || err.Error() != "unknown key z" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
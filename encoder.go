@@ -32,17 +32,44 @@
 package ucl
 
 import (
+	"bytes"
+	"encoding"
 	"fmt"
 	"io"
+	"math"
 	"reflect"
+	"regexp"
+	"sort"
 	"strings"
 	"strconv"
+	"unicode"
+	"unicode/utf8"
 )
 
 const (
 	parent_map = iota
 	parent_array
-	parent_anon
+)
+
+// Flags for EncodeFlags
+const (
+	// Write arrays of objects as repeated keys, i.e. "server {...}
+	// server {...}" instead of "server [{...}, {...}]". This can also be
+	// requested per struct field with the "implicit" tag option.
+	EncodeImplicitArrays = 1 << iota
+
+	// Collapse objects that hold a single object into the section
+	// shorthand, i.e. section "foo" "bar" {...} instead of
+	// section { foo { bar {...} } }.
+	EncodeSectionShorthand
+
+	// Write NaN and infinite floats as nan, inf and -inf. By default they
+	// are an error, as few readers accept them.
+	EncodeNonFinite
+
+	// Write "${" within string values as "$${", so that they read back
+	// unchanged with ParseReferences.
+	EncodeReferences
 )
 
 type encoder struct {
@@ -51,6 +78,23 @@ type encoder struct {
 	newline  string
 	tag      string
 	nilval   string
+	flags    int
+
+	path     string            // key path of the value being encoded
+	visiting map[visit] bool   // values being encoded, to detect cycles
+}
+
+// Identity of a map, slice or addressable struct
+type visit struct {
+	ptr uintptr
+	typ reflect.Type
+}
+
+// A key and its value, as gathered from a map or struct
+type entry struct {
+	key  string
+	v    reflect.Value
+	opts tagOptions    // options from the struct field's tag
 }
 
 // Encode v as UCL.
@@ -58,33 +102,89 @@ type encoder struct {
 // tag = if v has struct components, then use tag to search for the tag's key
 // nilval = (verbatim) string representing null value in output
 func Encode(w io.Writer, v interface{}, indenter, tag, nilval string) error {
+	return EncodeFlags(w, v, indenter, tag, nilval, 0)
+}
+
+// Encode v as UCL, with flags (EncodeXXX) controlling the output style.
+func EncodeFlags(w io.Writer, v interface{}, indenter, tag, nilval string,
+                 flags int) error {
 	newline := ""
 	if indenter != "" {
 		newline = "\n"
 	}
 
-	e := &encoder{w, indenter, newline, tag, nilval}
+	e := &encoder{
+		w:        w,
+		indenter: indenter,
+		newline:  newline,
+		tag:      tag,
+		nilval:   nilval,
+		flags:    flags,
+		visiting: make(map[visit] bool),
+	}
 	return e.doencode(reflect.ValueOf(v), parent_map, 0)
 }
 
-func (e *encoder) doencode(v reflect.Value, parenttype, indent int) error {
-	var indents string
-	for i := 0; i < indent; i++ {
-		indents += e.indenter
-	}
-
-	if v.Kind() == reflect.Ptr {
+// strip off pointer and interface wrappers; nil pointers, interfaces, maps
+// and slices all become an invalid (null) value
+func indirect(v reflect.Value) reflect.Value {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
 		v = v.Elem()
 	}
-	if v.Kind() == reflect.Interface {
-		v = v.Elem()
+	if (v.Kind() == reflect.Map || v.Kind() == reflect.Slice) && v.IsNil() {
+		return reflect.Value{}
 	}
+	return v
+}
 
+// Returns the identity of v if it can be part of a reference cycle
+func visitOf(v reflect.Value) (visit, bool) {
 	switch v.Kind() {
 	case reflect.Map:
-		if v.Type().Key().Kind() != reflect.String {
-			return fmt.Errorf("<map> %v %s", v, "does not use string key")
+		return visit{v.Pointer(), v.Type()}, true
+	case reflect.Slice:
+		// empty slices may all share the same (zero) pointer
+		if v.Len() > 0 {
+			return visit{v.Pointer(), v.Type()}, true
 		}
+	case reflect.Struct:
+		if v.CanAddr() {
+			return visit{v.Addr().Pointer(), v.Type()}, true
+		}
+	}
+	return visit{}, false
+}
+
+// The kind of v as far as encoding goes; regexes are structs that are
+// written out as scalars.
+func kindOf(v reflect.Value) reflect.Kind {
+	if v.IsValid() && (v.Type() == regexType || v.Type() == regexpType) {
+		return reflect.String
+	}
+	return v.Kind()
+}
+
+func (e *encoder) pathname() string {
+	if e.path == "" {
+		return "<root>"
+	}
+	return e.path
+}
+
+func (e *encoder) doencode(v reflect.Value, parenttype, indent int) error {
+	v = indirect(v)
+
+	if vis, ok := visitOf(v); ok {
+		if e.visiting[vis] {
+			return fmt.Errorf("%s: cycle detected encoding %s",
+			                  e.pathname(), v.Type())
+		}
+		e.visiting[vis] = true
+		defer delete(e.visiting, vis)
+	}
+
+	switch kindOf(v) {
+	case reflect.Map:
 		return e.encodeMap(v, parenttype, indent)
 	case reflect.Struct:
 		return e.encodeStruct(v, parenttype, indent)
@@ -95,219 +195,478 @@ func (e *encoder) doencode(v reflect.Value, parenttype, indent int) error {
 	}
 }
 
-// quote all strings that have non-alphanum
-func encodeStr(s string) string {
-	qs := strconv.Quote(s)
-	for i := 1; i < len(qs)-1; i++ {
-		if !((qs[i] >= 'A' && qs[i] <= 'Z') ||
-		     (qs[i] >= 'a' && qs[i] <= 'z') ||
-		     (qs[i] >= '0' && qs[i] <= '9')) {
-			return qs
+// Characters that can be written without quotes. Anything else may be
+// taken by the scanner as a separator, comment, quote or heredoc marker.
+func isBareChar(c byte) bool {
+	return (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') ||
+	       (c >= '0' && c <= '9') ||
+	       c == '_' || c == '-' || c == '.' || c == '/' || c == '+' || c == '@'
+}
+
+// Whether s can be written unquoted. A leading '/' would start a comment or
+// regex and a leading '.' a macro, so those are always quoted.
+func isBare(s string) bool {
+	if len(s) == 0 || s[0] == '/' || s[0] == '.' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isBareChar(s[i]) {
+			return false
 		}
 	}
-	return s
+	return true
 }
 
-func (e *encoder) encodeMap(v reflect.Value, parenttype, indent int) (err error) {
-	var indents string
-	for i := 0; i < indent; i++ {
-		indents += e.indenter
+// Whether s, unquoted, would be read as a number, or rejected as a
+// malformed one, when the parser types numbers
+func isNumeric(s string) bool {
+	for _, goforms := range []bool{false, true} {
+		if _, ok, bad := parseNumber(s, goforms); ok || bad >= 0 {
+			return true
+		}
 	}
+	return isNonFinite(s)
+}
 
-	// test if keyorder key exist
-	mv := v.MapIndex(reflect.ValueOf(KeyOrder))
-	if mv.Kind() != 0 {
-		if korder, ok := mv.Interface().([]string); ok {
-			for i := range korder {
-				if i > 0 {
-					fmt.Fprintf(e.w, e.newline)
-				}
-				fmt.Fprintf(e.w, "%s%s", indents, encodeStr(korder[i]))
+// Whether s can be single-quoted as-is; only worthwhile when it holds double
+// quotes that would otherwise need escaping.
+func isSingleQuotable(s string) bool {
+	if !strings.Contains(s, `"`) || strings.ContainsAny(s, `'\`) {
+		return false
+	}
+	if !utf8.ValidString(s) {
+		return false
+	}
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
 
-				cv := v.MapIndex(reflect.ValueOf(korder[i]))
-				if cv.Kind() == reflect.Ptr {
-					cv = cv.Elem()
-				}
-				if cv.Kind() == reflect.Interface {
-					cv = cv.Elem()
-				}
-				if cv.Kind() != reflect.Invalid {
-					fmt.Fprintf(e.w, " ")
-				}
+// Whether s should be written as a heredoc: more than 3 newlines and longer
+// than 160 characters
+func isHeredoc(s string) bool {
+	return len(s) > 160 && strings.Count(s, "\n") > 3
+}
 
-				switch cv.Kind() {
-				case reflect.Slice, reflect.Array:
-					err = e.doencode(cv, parent_map, indent)
-				case reflect.Map, reflect.Struct:
-					fmt.Fprintf(e.w, "{%s", e.newline)
-					err = e.doencode(cv, parent_map, indent + 1)
-					fmt.Fprintf(e.w, "%s}", indents)
-				default:
-					err = e.doencode(cv, parent_map, indent + 1)
-				}
-				if err != nil {
-					break
-				}
-				if parenttype != parent_array {
-					fmt.Fprintf(e.w, ";")
-				}
-			}
-			if err == nil && len(korder) > 0 {
-				fmt.Fprintf(e.w, e.newline)
-			}
-			return err
-		}
+// Pick a heredoc terminator that does not occur in s; the scanner ends the
+// heredoc on a line (or ';' separated segment) matching it.
+func heredocTag(s string) string {
+	tag := "EOSTR"
+	for i := 1; strings.Contains(s, tag); i++ {
+		tag = "EOSTR" + strconv.Itoa(i)
+	}
+	return tag
+}
+
+// Encode a key, quoting it if it cannot be read back as-is
+func encodeKey(s string) string {
+	if isBare(s) {
+		return s
 	}
-	keys := v.MapKeys()
-	for i := range keys {
-		if i > 0 {
-			fmt.Fprintf(e.w, e.newline)
+	return strconv.Quote(s)
+}
+
+// Whether every non-blank line of s starts with a space or tab, which a
+// <<-EOD heredoc would strip
+func isIndented(s string) bool {
+	for _, l := range strings.Split(s, "\n") {
+		if strings.TrimLeft(l, " \t") == "" {
+			continue
+		}
+		if l[0] != ' ' && l[0] != '\t' {
+			return false
 		}
-		fmt.Fprintf(e.w, "%s%s", indents,
-		            encodeStr(keys[i].Interface().(string)))
+	}
+	return true
+}
 
-		cv := v.MapIndex(keys[i])
-		if cv.Kind() == reflect.Ptr {
-			cv = cv.Elem()
+// Encode a string value as bare, single or double quoted, or heredoc,
+// whichever reads back identically and is the most legible. A heredoc
+// nested at indents is written as <<-EOD with its lines and terminator
+// indented to match.
+func encodeString(s string, parenttype int, indents, indenter string) string {
+	switch {
+	case isBare(s) && !isNumeric(s):
+		return s
+	case isHeredoc(s):
+		tag := heredocTag(s)
+		nl := ""
+		if parenttype == parent_array {
+			// terminator must be alone on its line, so keep the ','
+			// separator off it
+			nl = "\n"
 		}
-		if cv.Kind() == reflect.Interface {
-			cv = cv.Elem()
+		if indents == "" || isIndented(s) {
+			return "<<" + tag + "\n" + s + "\n" + tag + nl
 		}
-		if cv.Kind() != reflect.Invalid {
-			fmt.Fprintf(e.w, " ")
+		lines := strings.Split(s, "\n")
+		for i := range lines {
+			if lines[i] != "" {
+				lines[i] = indents + indenter + lines[i]
+			}
 		}
+		return "<<-" + tag + "\n" + strings.Join(lines, "\n") + "\n" +
+		       indents + tag + nl
+	case isSingleQuotable(s):
+		return "'" + s + "'"
+	default:
+		return strconv.Quote(s)
+	}
+}
 
-		switch cv.Kind() {
-		case reflect.Slice, reflect.Array:
-			err = e.doencode(cv, parent_map, indent)
-		case reflect.Map, reflect.Struct:
-			fmt.Fprintf(e.w, "{%s", e.newline)
-			err = e.doencode(cv, parent_map, indent + 1)
-			fmt.Fprintf(e.w, "%s}", indents)
-		default:
-			err = e.doencode(cv, parent_map, indent + 1)
+// true if v is a non-empty array whose elements are all maps or structs
+func isObjectArray(v reflect.Value) bool {
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		return false
+	}
+	if v.Len() == 0 {
+		return false
+	}
+	for i := 0; i < v.Len(); i++ {
+		cv := indirect(v.Index(i))
+		if kindOf(cv) != reflect.Map && kindOf(cv) != reflect.Struct {
+			return false
+		}
+	}
+	return true
+}
+
+func (e *encoder) encodeMap(v reflect.Value, parenttype, indent int) error {
+	entries, err := e.mapEntries(v)
+	if err != nil {
+		return err
+	}
+	return e.encodeEntries(entries, parenttype, indent)
+}
+
+var numberType = reflect.TypeOf(Number(""))
+
+var textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+
+// Convert a map key to the string written out for it
+func (e *encoder) keyString(k reflect.Value) (string, error) {
+	if k.Kind() == reflect.String {
+		return k.String(), nil
+	}
+	if k.Type().Implements(textMarshalerType) {
+		if k.Kind() == reflect.Ptr && k.IsNil() {
+			return "", nil
 		}
+		b, err := k.Interface().(encoding.TextMarshaler).MarshalText()
 		if err != nil {
-			break
+			return "", fmt.Errorf("%s: %v", e.pathname(), err)
 		}
-		if parenttype != parent_array {
-			fmt.Fprintf(e.w, ";")
+		return string(b), nil
+	}
+
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(k.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+	     reflect.Uint64, reflect.Uintptr:
+		return strconv.FormatUint(k.Uint(), 10), nil
+	case reflect.Bool:
+		return strconv.FormatBool(k.Bool()), nil
+	}
+	return "", fmt.Errorf("%s: %s %s", e.pathname(), k.Type(),
+	                      "cannot be used as a map key")
+}
+
+func (e *encoder) mapEntries(v reflect.Value) ([]entry, error) {
+	keytype := v.Type().Key()
+
+	// test if keyorder key exist
+	if keytype.Kind() == reflect.String {
+		mv := indirect(v.MapIndex(reflect.ValueOf(KeyOrder).Convert(keytype)))
+		if mv.Kind() == reflect.Slice && mv.CanInterface() {
+			if korder, ok := mv.Interface().([]string); ok {
+				entries := make([]entry, len(korder))
+				for i := range korder {
+					kv := reflect.ValueOf(korder[i]).Convert(keytype)
+					entries[i] = entry{key: korder[i], v: v.MapIndex(kv)}
+				}
+				return entries, nil
+			}
 		}
 	}
-	if err == nil && len(keys) > 0 {
-		fmt.Fprintf(e.w, e.newline)
+
+	entries := make([]entry, 0, v.Len())
+	iter := v.MapRange()
+	for iter.Next() {
+		k, err := e.keyString(iter.Key())
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry{key: k, v: iter.Value()})
 	}
 
-	return err
+	// no order given; sort so that output is stable
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].key < entries[j].key
+	})
+	return entries, nil
 }
 
-func (e *encoder) encodeStruct(v reflect.Value, parenttype, indent int) (err error) {
-	var indents string
-	for i := 0; i < indent; i++ {
-		indents += e.indenter
-	}
+func (e *encoder) encodeStruct(v reflect.Value, parenttype, indent int) error {
+	return e.encodeEntries(e.structEntries(v), parenttype, indent)
+}
 
-	nfields := v.Type().NumField()
-	cnt := 0
-	nonl := false
-	for i := 0; i < nfields; i++ {
-		if cnt > 0 && !nonl {
-			fmt.Fprintf(e.w, e.newline)
+func (e *encoder) structEntries(v reflect.Value) []entry {
+	entries := e.structEntriesOf(v, make(map[reflect.Type] bool))
+	if n, ok := typeNameOf(v.Type()); ok {
+		// write the discriminator first, unless a field holds it
+		for _, en := range entries {
+			if en.key == n.key {
+				return entries
+			}
 		}
-		nonl = false
+		entries = append([]entry{{n.key, reflect.ValueOf(n.value), ""}},
+		                 entries...)
+	}
+	return entries
+}
+
+// Gather the fields of struct v; embedded holds the types being flattened,
+// so that a struct embedding itself through a pointer is not recursed into
+func (e *encoder) structEntriesOf(v reflect.Value,
+                                  embedded map[reflect.Type] bool) []entry {
+	entries := make([]entry, 0, v.NumField())
+	embedded[v.Type()] = true
+	defer delete(embedded, v.Type())
 
+	for i := 0; i < v.NumField(); i++ {
 		cv := v.Field(i)
 		sf := v.Type().Field(i)
 
-		if cv.Kind() == reflect.Ptr {
-			cv = cv.Elem()
-		}
-		if cv.Kind() == reflect.Interface {
-			cv = cv.Elem()
+		name, opts := parseTag(sf.Tag.Get(e.tag))
+		if name == "-" && opts == "" {
+			// skip
+			continue
 		}
-		if sf.Anonymous {
+
+		if (sf.Anonymous && name == "") || opts.Contains("inline") {
+			cv = indirect(cv)
 			if cv.Kind() == reflect.Invalid {
-				nonl = true
 				continue
 			}
-
-			// Drill down into anonymous field and attempt encoding of it
-			err = e.encodeStruct(cv, parent_anon, indent)
-			if err != nil {
-				return err
+			if cv.Kind() == reflect.Struct {
+				if embedded[cv.Type()] {
+					continue
+				}
+				// Drill down into anonymous field and encode its
+				// members as our own
+				entries = append(entries, e.structEntriesOf(cv, embedded)...)
+				continue
 			}
 		}
-		cnt++
 
-		tag := sf.Tag.Get(e.tag)
-		if tag == "-" {
-			// skip
+		if sf.PkgPath != "" {
+			// unexported
+			continue
+		}
+		if opts.Contains("omitempty") && e.isEmpty(cv, opts) {
 			continue
 		}
+		if name == "" {
+			name = sf.Name
+		}
+		entries = append(entries, entry{name, cv, opts})
+	}
+	return entries
+}
 
-		if tag == "" {
-			if sf.Name[0] >= 'A' && sf.Name[0] <= 'Z' {
-				fmt.Fprintf(e.w, "%s%s", indents, sf.Name)
-			} else {
-				continue
+// Whether a field is empty for the purpose of omitempty. Fields with a
+// default are empty when equal to it, since decoding restores the default.
+func (e *encoder) isEmpty(v reflect.Value, opts tagOptions) bool {
+	if def, ok := opts.Get("default"); ok {
+		v = indirect(v)
+		if v.Kind() == reflect.Invalid {
+			return false
+		}
+		dv := reflect.New(v.Type()).Elem()
+		d := &decoder{tag: e.tag}
+		if d.decode(def, dv, "") != nil {
+			return false
+		}
+		switch v.Kind() {
+		case reflect.Bool:
+			return v.Bool() == dv.Bool()
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+		     reflect.Int64:
+			return v.Int() == dv.Int()
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		     reflect.Uint64, reflect.Uintptr:
+			return v.Uint() == dv.Uint()
+		case reflect.Float32, reflect.Float64:
+			return v.Float() == dv.Float()
+		case reflect.String:
+			return v.String() == dv.String()
+		}
+		return false
+	}
+
+	switch v.Kind() {
+	case reflect.Array, reflect.Map, reflect.Slice, reflect.String:
+		return v.Len() == 0
+	case reflect.Bool:
+		return !v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int() == 0
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+	     reflect.Uint64, reflect.Uintptr:
+		return v.Uint() == 0
+	case reflect.Float32, reflect.Float64:
+		return v.Float() == 0
+	case reflect.Interface, reflect.Ptr:
+		return v.IsNil()
+	}
+	return false
+}
+
+func (e *encoder) encodeEntries(entries []entry, parenttype, indent int) (err error) {
+	cnt := 0
+	for i := range entries {
+		cv := indirect(entries[i].v)
+		if (entries[i].opts.Contains("implicit") ||
+		    e.flags & EncodeImplicitArrays != 0) && isObjectArray(cv) {
+			// repeat the key for each object in the array
+			for j := 0; j < cv.Len() && err == nil; j++ {
+				err = e.encodeEntry(entries[i].key, indirect(cv.Index(j)),
+				                    entries[i].opts, parenttype, indent, cnt)
+				cnt++
 			}
 		} else {
-			// split at "," and get first
-			fmt.Fprintf(e.w, "%s%s", indents,
-			            encodeStr(strings.SplitN(tag, ",", 2)[0]))
+			err = e.encodeEntry(entries[i].key, cv, entries[i].opts,
+			                    parenttype, indent, cnt)
+			cnt++
 		}
-
-		if cv.Kind() != reflect.Invalid {
-			fmt.Fprintf(e.w, " ")
+		if err != nil {
+			return err
 		}
+	}
+	if cnt > 0 {
+		fmt.Fprint(e.w, e.newline)
+	}
+	return nil
+}
 
-		switch cv.Kind() {
-		case reflect.Slice, reflect.Array:
-			err = e.doencode(cv, parent_map, indent)
-		case reflect.Map, reflect.Struct:
-			fmt.Fprintf(e.w, "{%s", e.newline)
-			err = e.doencode(cv, parent_map, indent + 1)
-			fmt.Fprintf(e.w, "%s}", indents)
-		default:
-			err = e.doencode(cv, parent_map, indent + 1)
+// Write out "key value;", where cnt is the number of entries already
+// written in the current scope
+func (e *encoder) encodeEntry(key string, cv reflect.Value, opts tagOptions,
+                              parenttype, indent, cnt int) (err error) {
+	indents := strings.Repeat(e.indenter, indent)
+
+	parent := e.path
+	e.path = joinPath(parent, key)
+	defer func() { e.path = parent }()
+
+	if cnt > 0 {
+		fmt.Fprint(e.w, e.newline)
+	}
+	fmt.Fprintf(e.w, "%s%s", indents, encodeKey(key))
+
+	if cv.Kind() != reflect.Invalid {
+		fmt.Fprint(e.w, " ")
+	}
+
+	switch kindOf(cv) {
+	case reflect.Slice, reflect.Array:
+		err = e.doencode(cv, parent_map, indent)
+	case reflect.Map, reflect.Struct:
+		if e.flags & EncodeSectionShorthand != 0 {
+			seen := make(map[visit] bool)
+			for {
+				if vis, ok := visitOf(cv); ok {
+					if seen[vis] {
+						// cyclic; leave it to doencode to report
+						break
+					}
+					seen[vis] = true
+				}
+				k, nv, ok := e.singleObject(cv)
+				if !ok {
+					break
+				}
+				fmt.Fprintf(e.w, "%s ", strconv.Quote(k))
+				e.path = joinPath(e.path, k)
+				cv = nv
+			}
 		}
-		if err != nil {
+		fmt.Fprintf(e.w, "{%s", e.newline)
+		err = e.doencode(cv, parent_map, indent + 1)
+		fmt.Fprintf(e.w, "%s}", indents)
+	case reflect.Bool, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32,
+	     reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16,
+	     reflect.Uint32, reflect.Uint64, reflect.Uintptr, reflect.Float32,
+	     reflect.Float64:
+		if opts.Contains("string") {
+			// write out as a quoted string
+			var buf bytes.Buffer
+			se := *e
+			se.w = &buf
+			err = se.doencode(cv, parent_map, indent + 1)
+			fmt.Fprint(e.w, strconv.Quote(buf.String()))
 			break
 		}
-		fmt.Fprintf(e.w, ";")
+		err = e.doencode(cv, parent_map, indent + 1)
+	default:
+		err = e.doencode(cv, parent_map, indent + 1)
 	}
-	if err == nil && nfields > 0 && parenttype != parent_array &&
-	   parenttype != parent_anon{
-		fmt.Fprintf(e.w, e.newline)
+	if err != nil {
+		return err
 	}
-
-	return err
+	// entries of an object always end with ";", even within an array,
+	// as the compact form has nothing else to separate them
+	fmt.Fprint(e.w, ";")
+	return nil
 }
 
+// If v is an object with exactly one member and that member is itself an
+// object, return the member's key and value
+func (e *encoder) singleObject(v reflect.Value) (string, reflect.Value, bool) {
+	var entries []entry
+	switch v.Kind() {
+	case reflect.Map:
+		var err error
+		if entries, err = e.mapEntries(v); err != nil {
+			// left for doencode to report
+			return "", v, false
+		}
+	case reflect.Struct:
+		entries = e.structEntries(v)
+	}
+	if len(entries) != 1 {
+		return "", v, false
+	}
+
+	cv := indirect(entries[0].v)
+	if kindOf(cv) != reflect.Map && kindOf(cv) != reflect.Struct {
+		return "", v, false
+	}
+	return entries[0].key, cv, true
+}
 
 func (e *encoder) encodeSlice(v reflect.Value, parenttype, indent int) (err error) {
-	var indents string
-	for i := 0; i < indent; i++ {
-		indents += e.indenter
-	}
+	indents := strings.Repeat(e.indenter, indent)
 
-	fmt.Fprintf(e.w, "[")
+	parent := e.path
+	defer func() { e.path = parent }()
+
+	fmt.Fprint(e.w, "[")
 	for i := 0; i < v.Len(); i++ {
+		e.path = fmt.Sprintf("%s[%d]", parent, i)
 		if i == 0 {
-			fmt.Fprintf(e.w, e.newline)
+			fmt.Fprint(e.w, e.newline)
 		} else {
 			fmt.Fprintf(e.w, ",%s", e.newline)
 		}
 
-		cv := v.Index(i)
-		if cv.Kind() == reflect.Ptr {
-			cv = cv.Elem()
-		}
-		if cv.Kind() == reflect.Interface {
-			cv = cv.Elem()
-		}
+		cv := indirect(v.Index(i))
 
-		switch cv.Kind() {
+		switch kindOf(cv) {
 		case reflect.Slice, reflect.Array:
 			err = e.doencode(cv, parent_array, indent)
 		case reflect.Map, reflect.Struct:
@@ -322,62 +681,74 @@ func (e *encoder) encodeSlice(v reflect.Value, parenttype, indent int) (err erro
 		}
 	}
 	if v.Len() > 0 {
-		fmt.Fprintf(e.w, e.newline)
+		fmt.Fprint(e.w, e.newline)
 		fmt.Fprintf(e.w, "%s]", indents)
 	} else {
-		fmt.Fprintf(e.w, "]")
+		fmt.Fprint(e.w, "]")
 	}
 	return err
 }
 
 func (e *encoder) encodeScalar(v reflect.Value, parenttype, indent int) (err error) {
-	var indents string
-	for i := 0; i < indent; i++ {
-		indents += e.indenter
-	}
+	indents := strings.Repeat(e.indenter, indent)
 
 	if parenttype == parent_array {
 		fmt.Fprintf(e.w, "%s", indents)
 	}
 
-	if v.Kind() == reflect.Interface {
-		v = v.Elem()
+	if v.IsValid() && (v.Type() == regexType || v.Type() == regexpType) {
+		return e.encodeRegex(v)
 	}
 
+	// values reached through unexported embedded structs cannot be
+	// Interface()'d, so format by kind
 	switch v.Kind() {
 	case reflect.Bool:
 		fmt.Fprintf(e.w, "%t", v.Bool())
 	case reflect.String:
-		mlstring := false
-		s := v.String()
-		nl := 0
-		// push as multiline string if there are more than 3 newlines and
-		// string is longer than 160 characters
-		if len(s) > 160 {
-			for i := range s {
-				if s[i] == '\n' {
-					nl++
-					if nl > 3 {
-						break
-					}
-				}
+		if v.Type() == numberType {
+			// written verbatim, so must really be a number, in any of
+			// the forms the parser reads
+			n := v.String()
+			if _, ok, _ := parseNumber(n, true); !ok {
+				return fmt.Errorf("%s: invalid number %q", e.pathname(), n)
 			}
-		}
-		if nl > 3  {
-			mlstring = true
-			fmt.Fprintf(e.w, "<<EOSTR\n")
-		} else if len(s) == 0 {
-			fmt.Fprintf(e.w, `""`)
-			break
-		} else if s[0] != '/' {
-			fmt.Fprintf(e.w, encodeStr(s))
+			fmt.Fprint(e.w, n)
 			break
 		}
-
-		fmt.Fprintf(e.w, "%s", s)
-		if mlstring {
-			fmt.Fprintf(e.w, "\nEOSTR")
+		s := v.String()
+		if e.flags & EncodeReferences != 0 {
+			s = strings.Replace(s, "${", "$${", -1)
+		}
+		// heredoc lines go one level inside the key or array element
+		hindents := indents
+		if parenttype == parent_map && indent > 0 {
+			hindents = strings.Repeat(e.indenter, indent-1)
+		}
+		fmt.Fprint(e.w, encodeString(s, parenttype, hindents, e.indenter))
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		fmt.Fprint(e.w, strconv.FormatInt(v.Int(), 10))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+	     reflect.Uint64, reflect.Uintptr:
+		fmt.Fprint(e.w, strconv.FormatUint(v.Uint(), 10))
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			if e.flags & EncodeNonFinite == 0 {
+				return fmt.Errorf("%s: unsupported value %v", e.pathname(), f)
+			}
+			switch {
+			case math.IsNaN(f):
+				fmt.Fprint(e.w, "nan")
+			case f > 0:
+				fmt.Fprint(e.w, "inf")
+			default:
+				fmt.Fprint(e.w, "-inf")
+			}
+			break
 		}
+		fmt.Fprint(e.w, formatFloat(f, v.Type().Bits()))
 
 	case reflect.Invalid:
 		if e.nilval != "" {
@@ -385,7 +756,27 @@ func (e *encoder) encodeScalar(v reflect.Value, parenttype, indent int) (err err
 		}
 
 	default:
-		fmt.Fprintf(e.w, "%v", v.Interface())
+		return fmt.Errorf("%s: cannot encode %s", e.pathname(), v.Type())
+	}
+	return nil
+}
+
+// Write a Regex or regexp.Regexp in its /source/flags form
+func (e *encoder) encodeRegex(v reflect.Value) error {
+	if !v.CanInterface() {
+		return fmt.Errorf("%s: cannot encode %s", e.pathname(), v.Type())
+	}
+	if r, ok := v.Interface().(Regex); ok {
+		fmt.Fprint(e.w, r)
+		return nil
+	}
+	if !v.CanAddr() {
+		// regexp.Regexp must be used through a pointer
+		pv := reflect.New(v.Type())
+		pv.Elem().Set(v)
+		v = pv.Elem()
 	}
+	re := v.Addr().Interface().(*regexp.Regexp)
+	fmt.Fprint(e.w, Regex{Source: re.String()})
 	return nil
 }
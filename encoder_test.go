@@ -0,0 +1,518 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"testing"
+	"bytes"
+	"fmt"
+	"reflect"
+	"regexp"
+	"math"
+	"strings"
+)
+
+func TestEncodeImplicitArray(t *testing.T) {
+	type backend struct {
+		Host string `json:"host"`
+		Port int    `json:"port"`
+	}
+	var cfg struct {
+		Server []backend `json:"server,implicit"`
+		Listen []backend `json:"listen"`
+	}
+	cfg.Server = []backend{{"a", 80}, {"b", 81}}
+	cfg.Listen = []backend{{"c", 82}}
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, &cfg, "\t", "json", ""); err != nil {
+		t.Fatal(err)
+	}
+	expect := "server {\n\thost a;\n\tport 80;\n};\n" +
+	          "server {\n\thost b;\n\tport 81;\n};\n" +
+	          "listen [\n\t{\n\t\thost c;\n\t\tport 82;\n\t}\n];\n"
+	if buf.String() != expect {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+
+	p := NewParser(&buf)
+	ucl, err := p.Ucl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers, ok := ucl["server"].([]interface{})
+	if !ok || len(servers) != 2 {
+		t.Fatalf("server did not parse as an array: %v", ucl["server"])
+	}
+
+	// the flag applies to untagged arrays too
+	buf.Reset()
+	m := map[string] interface{}{
+		"x": []interface{}{
+			map[string] interface{}{"a": "1"},
+			map[string] interface{}{"a": "2"},
+		},
+	}
+	err = EncodeFlags(&buf, m, "", "json", "", EncodeImplicitArrays)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != `x {a "1";};x {a "2";};` {
+		t.Fatalf("unexpected output: %s", buf.String())
+	}
+}
+
+func TestEncodeSectionShorthand(t *testing.T) {
+	s := `
+section foo bar {
+	x 1;
+}
+other {
+	a b;
+	c d;
+}
+`
+	p := NewParser(bytes.NewBufferString(s))
+	ucl, err := p.Ucl()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = EncodeFlags(&buf, ucl, "\t", "json", "", EncodeSectionShorthand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := "section \"foo\" \"bar\" {\n\tx \"1\";\n};\n" +
+	          "other {\n\ta b;\n\tc d;\n};\n"
+	if buf.String() != expect {
+		t.Fatalf("unexpected output:\n%s", buf.String())
+	}
+
+	// must parse back to the same shape
+	b1 := buf.String()
+	p = NewParser(&buf)
+	ucl, err = p.Ucl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	EncodeFlags(&buf, ucl, "\t", "json", "", EncodeSectionShorthand)
+	if buf.String() != b1 {
+		t.Fatalf("round trip differs:\n%s\nvs\n%s", b1, buf.String())
+	}
+}
+
+func TestEncodeQuoting(t *testing.T) {
+	long := strings.Repeat("a line of text that goes on for a while\n", 6)
+	strs := []string{
+		"plain",
+		"",
+		"with space",
+		" leading and trailing ",
+		"/some_regex/",
+		"/usr/local/bin",
+		".hidden",
+		"# not a comment",
+		"semi;colon",
+		"a<<b",
+		"equals=sign",
+		"colon:sep",
+		"brace{}",
+		"comma,sep",
+		`double"quote`,
+		`single'quote`,
+		`both'"quotes`,
+		`back\slash`,
+		"new\nline",
+		"tab\there",
+		"ünïcödé",
+		"123",
+		"-1.5e3",
+		"0x10",
+		"0b101",
+		"1_000",
+		"0o758",
+		"inf",
+		"-Inf",
+		"nan",
+		"\x00\x01binary\xff",
+		"${ref}",
+		"cost $5, or $${5}",
+		"$$${x}",
+		long,
+		long + "EOSTR\n" + long,
+		long + "x;EOSTR1;y\n" + long + "EOSTR",
+	}
+
+	var keys []string
+	m := make(map[string] interface{})
+	for i := range strs {
+		m[strs[i]] = strs[i]
+		keys = append(keys, strs[i])
+	}
+	m[KeyOrder] = keys
+	m["list"] = strs
+	keys = append(keys, "list")
+	m[KeyOrder] = keys
+
+	// strings must stay strings when numbers are typed, and stay as they
+	// are when references are resolved
+	tests := []struct {
+		encode int
+		parse  int
+	}{
+		{0, 0},
+		{0, ParseNumbers | ParseGoNumbers},
+		{EncodeReferences, ParseReferences},
+	}
+	for _, indent := range []string{"", "\t"} {
+		for _, test := range tests {
+			var buf bytes.Buffer
+			err := EncodeFlags(&buf, m, indent, "json", "", test.encode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out := buf.String()
+
+			p := NewParserFlags(strings.NewReader(out), test.parse)
+			ucl, err := p.Ucl()
+			if err != nil {
+				t.Fatalf("%v parsing:\n%s", err, out)
+			}
+
+			for i := range strs {
+				if v, ok := ucl[strs[i]].(string); !ok || v != strs[i] {
+					t.Errorf("key %q: got %#v in:\n%s", strs[i],
+					         ucl[strs[i]], out)
+				}
+			}
+			list, ok := ucl["list"].([]interface{})
+			if !ok || len(list) != len(strs) {
+				t.Fatalf("list did not round trip: %v\n%s", ucl["list"], out)
+			}
+			for i := range strs {
+				if list[i] != strs[i] {
+					t.Errorf("list[%d]: got %#v, want %q", i, list[i],
+					         strs[i])
+				}
+			}
+		}
+	}
+}
+
+func TestEncodeCycles(t *testing.T) {
+	type node struct {
+		Name string `json:"name"`
+		Next *node  `json:"next"`
+	}
+	a := &node{Name: "a"}
+	a.Next = &node{Name: "b", Next: a}
+
+	var buf bytes.Buffer
+	err := Encode(&buf, a, "", "json", "")
+	if err == nil || err.Error() != "next.next: cycle detected encoding ucl.node" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	m := map[string] interface{}{"x": "y"}
+	m["self"] = []interface{}{m}
+	buf.Reset()
+	err = Encode(&buf, m, "", "json", "")
+	if err == nil || err.Error() != "self[0]: cycle detected encoding map[string]interface {}" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// the same value twice is not a cycle
+	b := &node{Name: "b"}
+	buf.Reset()
+	err = Encode(&buf, []*node{b, b}, "", "json", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncodeNils(t *testing.T) {
+	type inner struct {
+		N int `json:"n"`
+	}
+	var ip *int
+	var v struct {
+		inner
+		Map   map[string] string `json:"map"`
+		Slice []string           `json:"slice"`
+		Ptr   *inner             `json:"ptr"`
+		PPtr  **int              `json:"pptr"`
+		Intf  interface{}        `json:"intf"`
+		Empty []string           `json:"empty"`
+	}
+	v.N = 5
+	v.PPtr = &ip
+	v.Empty = []string{}
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, &v, "", "json", "null"); err != nil {
+		t.Fatal(err)
+	}
+	expect := "n 5;map null;slice null;ptr null;pptr null;intf null;empty [];"
+	if buf.String() != expect {
+		t.Fatalf("unexpected output: %s", buf.String())
+	}
+}
+
+func TestEncodeNumbers(t *testing.T) {
+	type nums struct {
+		I   int64   `json:"i"`
+		U   uint64  `json:"u"`
+		F   float64 `json:"f"`
+		F32 float32 `json:"f32"`
+		Big float64 `json:"big"`
+		Min float64 `json:"min"`
+		N   Number  `json:"n"`
+	}
+	in := nums{-9007199254740993, 18446744073709551615, 1e6, 0.1, 1e21,
+	           5e-324, "0.10"}
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, &in, "", "json", ""); err != nil {
+		t.Fatal(err)
+	}
+	expect := "i -9007199254740993;u 18446744073709551615;f 1000000;" +
+	          "f32 0.1;big 1e+21;min 5e-324;n 0.10;"
+	if buf.String() != expect {
+		t.Fatalf("unexpected output: %s", buf.String())
+	}
+
+	for _, flags := range []int{0, ParseNumbers, ParseUseNumber} {
+		p := NewParserFlags(bytes.NewBufferString(buf.String()), flags)
+		ucl, err := p.Ucl()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var out nums
+		if err = Decode(ucl, &out, "json"); err != nil {
+			t.Fatal(err)
+		}
+		if flags == ParseNumbers {
+			// parsed as a float64, so the literal is not kept
+			out.N = in.N
+		}
+		if out != in {
+			t.Errorf("flags %d: got %+v, want %+v", flags, out, in)
+		}
+	}
+
+	buf.Reset()
+	err := Encode(&buf, map[string] float64{"x": math.Inf(1)}, "", "json", "")
+	if err == nil || err.Error() != "x: unsupported value +Inf" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	m := map[string] float64{"a": math.NaN(), "b": math.Inf(1),
+	                         "c": math.Inf(-1)}
+	buf.Reset()
+	err = EncodeFlags(&buf, m, "", "json", "", EncodeNonFinite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "a nan;b inf;c -inf;" {
+		t.Fatalf("unexpected output: %s", buf.String())
+	}
+
+	// Numbers keep the literal the parser read, in every form
+	s := "mask 0xff00;neg -0x10;perm 0o755;bits 0b1010;big 1_000;f 1.5e3;"
+	flags := ParseUseNumber | ParseGoNumbers
+	ucl, err := NewParserFlags(strings.NewReader(s), flags).Ucl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(ucl, KeyOrder)
+	buf.Reset()
+	if err = Encode(&buf, ucl, "", "json", ""); err != nil {
+		t.Fatal(err)
+	}
+	again, err := NewParserFlags(&buf, flags).Ucl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(again, KeyOrder)
+	if !reflect.DeepEqual(again, ucl) || ucl["perm"] != Number("0o755") {
+		t.Errorf("got %v, want %v", again, ucl)
+	}
+
+	buf.Reset()
+	err = Encode(&buf, map[string] Number{"x": "0x"}, "", "json", "")
+	if err == nil || err.Error() != `x: invalid number "0x"` {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestEncodeRegex(t *testing.T) {
+	tests := []struct {
+		src   string
+		match string
+	}{
+		{`^[a-z]+$`, "ABC"},
+		{`a{2}`, "xAAx"},
+		{`a b;c/d`, "A B;C/D"},
+		{`"q" 'r'`, `"Q" 'R'`},
+		{`x=y:z`, "X=Y:Z"},
+		{`[{]`, "{"},
+		{`\d+\/`, "12/"},
+	}
+
+	m := make(map[string] interface{})
+	var keys []string
+	for i := range tests {
+		k := fmt.Sprintf("r%d", i)
+		m[k] = Regex{tests[i].src, "i"}
+		keys = append(keys, k)
+	}
+	m["list"] = []interface{}{Regex{`a b`, ""}, regexp.MustCompile(`x;y`)}
+	keys = append(keys, "list")
+	m[KeyOrder] = keys
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, m, "\t", "json", ""); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+
+	p := NewParserFlags(&buf, ParseRegex)
+	ucl, err := p.Ucl()
+	if err != nil {
+		t.Fatalf("%v parsing:\n%s", err, out)
+	}
+	for i, tt := range tests {
+		r, ok := ucl[fmt.Sprintf("r%d", i)].(Regex)
+		if !ok || r.Flags != "i" {
+			t.Errorf("r%d: got %#v in:\n%s", i, r, out)
+			continue
+		}
+		re, err := r.Compile()
+		if err != nil || !re.MatchString(tt.match) {
+			t.Errorf("r%d: %v does not match %q (%v)", i, r, tt.match, err)
+		}
+	}
+	list, _ := ucl["list"].([]interface{})
+	if len(list) != 2 {
+		t.Fatalf("list: got %v in:\n%s", list, out)
+	}
+	for i, s := range []string{"a b", "x;y"} {
+		re, err := list[i].(Regex).Compile()
+		if err != nil || !re.MatchString(s) {
+			t.Errorf("list[%d]: %v does not match %q", i, list[i], s)
+		}
+	}
+}
+
+func TestEncodeNestedHeredoc(t *testing.T) {
+	long := strings.Repeat("a line that makes this string long\n", 5) +
+	        "  indented\n\n \nend"
+	shifted := "  " + strings.Replace(long, "\n", "\n  ", -1)
+	m := map[string] interface{}{
+		"top": long,
+		"section": map[string] interface{}{
+			"text":    long,
+			"shifted": shifted,
+			"list":    []interface{}{long, "x"},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, m, "\t", "", ""); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, s := range []string{"\ttext <<-EOSTR\n\t\ta line",
+	                           "\n\tEOSTR;", "\n\t\tEOSTR\n",
+	                           "\tshifted <<EOSTR\n  a line",
+	                           "top <<EOSTR\na line"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("missing %q in:\n%s", s, out)
+		}
+	}
+
+	ucl, err := NewParser(&buf).Ucl()
+	if err != nil {
+		t.Fatalf("%v parsing:\n%s", err, out)
+	}
+	section := ucl["section"].(map[string] interface{})
+	list := section["list"].([]interface{})
+	if ucl["top"] != long || section["text"] != long ||
+	   section["shifted"] != shifted || list[0] != long {
+		t.Errorf("round trip mismatch:\n%s", out)
+	}
+}
+
+func TestEncodeCompactArrays(t *testing.T) {
+	type backend struct {
+		Host string `json:"host"`
+		Port int    `json:"port"`
+	}
+	in := struct {
+		L []backend              `json:"l"`
+		M []map[string] interface{} `json:"m"`
+	}{
+		L: []backend{{"a", 1}, {"c", 2}},
+		M: []map[string] interface{}{{"host": "a", "port": 1}},
+	}
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, &in, "", "json", ""); err != nil {
+		t.Fatal(err)
+	}
+	expect := `l [{host a;port 1;},{host c;port 2;}];m [{host a;port 1;}];`
+	if buf.String() != expect {
+		t.Fatalf("unexpected output: %s", buf.String())
+	}
+
+	p := NewParserFlags(&buf, ParseNumbers)
+	ucl, err := p.Ucl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, _ := ucl["l"].([]interface{})
+	if len(l) != 2 {
+		t.Fatalf("l: got %v", ucl["l"])
+	}
+	for i, b := range in.L {
+		o, _ := l[i].(map[string] interface{})
+		if o["host"] != b.Host || o["port"] != int64(b.Port) {
+			t.Errorf("l[%d]: got %v", i, l[i])
+		}
+	}
+	m, _ := ucl["m"].([]interface{})
+	if len(m) != 1 {
+		t.Fatalf("m: got %v", ucl["m"])
+	}
+	if o, _ := m[0].(map[string] interface{}); o["host"] != "a" ||
+	   o["port"] != int64(1) {
+		t.Errorf("m: got %v", ucl["m"])
+	}
+}
@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Size limit of a URL's contents when HTTPOptions.MaxSize is 0
+const defaultMaxSize = 1 << 20
+
+// Allows .include and .load to read http and https URLs
+type HTTPOptions struct {
+	Client   *http.Client  // http.DefaultClient if nil
+	Timeout  time.Duration // of each request, if not 0
+	MaxSize  int64         // largest content accepted; 1MB if 0
+
+	// If set, contents are kept here and revalidated with their ETag. The
+	// cached copy is also used when the server cannot be reached.
+	CacheDir string
+}
+
+// Allow .include and .load of URLs, which are otherwise refused. Relative
+// names within a file read from a URL are resolved against that URL.
+func (p *Parser) SetHTTP(opts *HTTPOptions) {
+	p.http = opts
+}
+
+func isURL(name string) bool {
+	return strings.HasPrefix(name, "http://") ||
+	       strings.HasPrefix(name, "https://")
+}
+
+func (p *Parser) resolveURL(name string) (string, error) {
+	if p.http == nil {
+		return "", fmt.Errorf("%s: URLs are not enabled", name)
+	}
+	u, err := url.Parse(name)
+	if err != nil {
+		return "", err
+	}
+	if p.base != nil {
+		u = p.base.ResolveReference(u)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", fmt.Errorf("%s is not an http or https URL", name)
+	}
+	return u.String(), nil
+}
+
+// Get the contents of a URL, from the cache if unchanged
+func (p *Parser) fetch(u string) ([]byte, error) {
+	o := p.http
+
+	var cache, etag string
+	var cached []byte
+	if o.CacheDir != "" {
+		sum := sha256.Sum256([]byte(u))
+		cache = filepath.Join(o.CacheDir, hex.EncodeToString(sum[:]))
+		if b, err := ioutil.ReadFile(cache); err == nil {
+			cached = b
+			if b, err = ioutil.ReadFile(cache + ".etag"); err == nil {
+				etag = string(b)
+			}
+		}
+	}
+
+	ctx := context.Background()
+	if o.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.Timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+
+	client := o.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		if cached != nil {
+			return cached, nil
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && cached != nil:
+		return cached, nil
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("%s: %s", u, resp.Status)
+	}
+
+	max := o.MaxSize
+	if max <= 0 {
+		max = defaultMaxSize
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, max + 1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, fmt.Errorf("%s is larger than %d bytes", u, max)
+	}
+
+	if cache != "" {
+		// the cache only saves requests, so failing to update it is not
+		// an error
+		storeCache(cache, data, resp.Header.Get("ETag"))
+	}
+	return data, nil
+}
+
+// Save data and its etag as the cached copy in file
+func storeCache(file string, data []byte, etag string) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	// drop the old etag first, so that it can never be paired with the
+	// new data
+	err := os.Remove(file + ".etag")
+	if err == nil || os.IsNotExist(err) {
+		err = os.Rename(tmp, file)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if etag == "" {
+		return nil
+	}
+	return ioutil.WriteFile(file + ".etag", []byte(etag), 0644)
+}
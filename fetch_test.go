@@ -0,0 +1,174 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIncludeHTTP(t *testing.T) {
+	var notmodified int32
+	files := map[string] string{
+		"/shared/base.conf":  ".include \"extra.conf\"\nbase = yes;\n",
+		"/shared/extra.conf": "extra = yes;\n",
+	}
+	srv := httptest.NewServer(http.HandlerFunc(
+	    func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/big":
+			w.Write([]byte(strings.Repeat("x", 200)))
+			return
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+			return
+		}
+		data, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		etag := `"` + r.URL.Path + `"`
+		if r.Header.Get("If-None-Match") == etag {
+			atomic.AddInt32(&notmodified, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(data))
+	}))
+	defer srv.Close()
+
+	cache, err := ioutil.TempDir("", "uclcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache)
+	opts := &HTTPOptions{
+		Client:   srv.Client(),
+		Timeout:  50 * time.Millisecond,
+		MaxSize:  100,
+		CacheDir: cache,
+	}
+
+	parse := func(s string, opts *HTTPOptions) (map[string] interface{}, error) {
+		p := NewParser(strings.NewReader(s + "\n"))
+		p.SetHTTP(opts)
+		return p.Ucl()
+	}
+	include := `.include "` + srv.URL + `/shared/base.conf"`
+
+	if _, err = parse(include, nil); err == nil ||
+	   !strings.Contains(err.Error(), "URLs are not enabled") {
+		t.Errorf("without SetHTTP: got error %v", err)
+	}
+
+	// fetched, then revalidated, then from the cache once the server is
+	// gone
+	check := func(pass int) {
+		ucl, err := parse(include, opts)
+		if err != nil || ucl["base"] != "yes" || ucl["extra"] != "yes" {
+			t.Errorf("pass %d: got %v, %v", pass, ucl, err)
+		}
+	}
+	check(0)
+	check(1)
+	if n := atomic.LoadInt32(&notmodified); n != 2 {
+		t.Errorf("got %d not modified responses, want 2", n)
+	}
+
+	errors := map[string] string{
+		"/big":     "larger than 100 bytes",
+		"/slow":    "deadline exceeded",
+		"/missing": "404 Not Found",
+	}
+	opts.CacheDir = ""
+	for path, msg := range errors {
+		_, err := parse(`.load(key=x) "` + srv.URL + path + `"`, opts)
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%s: got error %v, want %q", path, err, msg)
+		}
+	}
+
+	opts.CacheDir = cache
+	srv.CloseClientConnections()
+	srv.Listener.Close()
+	check(2)
+}
+
+func TestStoreCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ucltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "entry")
+
+	read := func() (string, string) {
+		data, _ := ioutil.ReadFile(file)
+		etag, _ := ioutil.ReadFile(file + ".etag")
+		return string(data), string(etag)
+	}
+
+	if err := storeCache(file, []byte("one"), `"1"`); err != nil {
+		t.Fatal(err)
+	}
+	if data, etag := read(); data != "one" || etag != `"1"` {
+		t.Errorf("got %q %q", data, etag)
+	}
+	if err := storeCache(file, []byte("two"), ""); err != nil {
+		t.Fatal(err)
+	}
+	if data, etag := read(); data != "two" || etag != "" {
+		t.Errorf("without etag: got %q %q", data, etag)
+	}
+
+	// when the old etag cannot be removed, the old data stays with it
+	if err := storeCache(file, []byte("three"), `"3"`); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(file + ".etag")
+	writeFiles(t, dir, map[string] string{"entry.etag/x": ""})
+	if err := storeCache(file, []byte("four"), `"4"`); err == nil {
+		t.Errorf("expected error")
+	}
+	if data, _ := read(); data != "three" {
+		t.Errorf("data replaced: got %q", data)
+	}
+	if _, err := os.Stat(file + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind")
+	}
+}
@@ -0,0 +1,223 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"flag"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Flags registered by BindFlags for the fields of a struct
+type FlagBinding struct {
+	flags *flag.FlagSet
+	v     reflect.Value
+	d     *decoder
+}
+
+// A flag for a field, at path from the bound struct, holding the values it
+// was given until they are applied
+type flagValue struct {
+	b      *FlagBinding
+	path   []string
+	t      reflect.Type
+	def    string
+	isbool bool
+	multi  bool // a slice, whose values are given by repeating the flag
+	vals   []interface{}
+}
+
+func (f *flagValue) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.def
+}
+
+func (f *flagValue) Set(s string) error {
+	// check the value decodes now, so flag.Parse reports it
+	tmp := reflect.New(f.t).Elem()
+	if err := f.b.d.decode(s, tmp, strings.Join(f.path, ".")); err != nil {
+		return err
+	}
+	if !f.multi {
+		f.vals = f.vals[:0]
+	}
+	f.vals = append(f.vals, s)
+	return nil
+}
+
+func (f *flagValue) IsBoolFlag() bool {
+	return f.isbool
+}
+
+// Register a flag on fs for each field of the struct that v points to, as
+// Decode would set it with tag, e.g. -server.port for a Port field within a
+// Server struct. The flag's help is the field's "usage" tag. Slices are set
+// by repeating their flag. Once flags are parsed, and the configuration
+// decoded into v, Apply sets the fields whose flags were given.
+func BindFlags(fs *flag.FlagSet, v interface{}, tag string) (*FlagBinding, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("cannot bind flags to %T", v)
+	}
+
+	b := &FlagBinding{flags: fs, v: rv.Elem(), d: &decoder{tag: tag}}
+	b.bind(rv.Elem(), nil, make(map[reflect.Type] bool))
+	return b, nil
+}
+
+// Register flags for the fields of struct v; nested holds the struct types
+// on the path to v, so that a type containing itself through a pointer is
+// not recursed into
+func (b *FlagBinding) bind(v reflect.Value, path []string,
+                           nested map[reflect.Type] bool) {
+	nested[v.Type()] = true
+	defer delete(nested, v.Type())
+
+	for _, f := range b.d.structFields(v) {
+		fv, t := f.v, f.t
+		if !fv.IsValid() {
+			// behind a nil embedded pointer
+			fv = reflect.New(t).Elem()
+		}
+		for t.Kind() == reflect.Ptr && t != regexpPtrType {
+			t = t.Elem()
+			if fv.IsNil() {
+				fv = reflect.New(t).Elem()
+			} else {
+				fv = fv.Elem()
+			}
+		}
+		fpath := append(path[:len(path):len(path)], f.name)
+
+		if t.Kind() == reflect.Struct && t != regexType && t != regexpType {
+			if !nested[t] {
+				b.bind(fv, fpath, nested)
+			}
+			continue
+		}
+
+		et := t
+		multi := false
+		if t.Kind() == reflect.Slice || t.Kind() == reflect.Array {
+			et = t.Elem()
+			multi = true
+		}
+		switch et.Kind() {
+		case reflect.Map, reflect.Interface, reflect.Func, reflect.Chan,
+		     reflect.Slice, reflect.Array, reflect.UnsafePointer:
+			continue
+		case reflect.Struct:
+			if et != regexType && et != regexpType {
+				continue
+			}
+		}
+
+		def := ""
+		if d, ok := f.opts.Get("default"); ok && fv.IsZero() {
+			def = d
+		} else if !fv.IsZero() {
+			def = fmt.Sprint(fv.Interface())
+		}
+
+		b.flags.Var(&flagValue{
+			b: b,
+			path: fpath,
+			t: f.t,
+			def: def,
+			isbool: t.Kind() == reflect.Bool,
+			multi: multi,
+		}, strings.Join(fpath, "."), f.usage)
+	}
+}
+
+// Set the fields whose flags were given on the command line, checking them
+// against their validate tags; failures are returned as ValidationErrors
+func (b *FlagBinding) Apply() error {
+	var err error
+	b.d.invalid = nil
+	b.flags.Visit(func(fl *flag.Flag) {
+		f, ok := fl.Value.(*flagValue)
+		if !ok || f.b != b || err != nil {
+			return
+		}
+		err = b.apply(f)
+	})
+	if err == nil && len(b.d.invalid) > 0 {
+		err = b.d.invalid
+	}
+	return err
+}
+
+func (b *FlagBinding) apply(f *flagValue) error {
+	v := b.v
+	for i, name := range f.path {
+		var sf field
+		found := false
+		for _, sf = range b.d.structFields(v) {
+			if sf.name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: no such field", strings.Join(f.path, "."))
+		}
+		fv := sf.alloc(v)
+		if i == len(f.path) - 1 {
+			var in interface{} = f.vals[len(f.vals)-1]
+			if f.multi {
+				in = f.vals
+			}
+			path := strings.Join(f.path, ".")
+			if err := b.d.decode(in, fv, path); err != nil {
+				return err
+			}
+			return b.d.validate(sf, fv, true, path, path)
+		}
+		for fv.Kind() == reflect.Ptr {
+			if fv.IsNil() {
+				// as an empty object, so the struct gets its defaults;
+				// its fields are only checked as their flags set them
+				n := len(b.d.invalid)
+				err := b.d.decode(map[string] interface{}{}, fv,
+				                  strings.Join(f.path[:i+1], "."))
+				if err != nil {
+					return err
+				}
+				b.d.invalid = b.d.invalid[:n]
+			}
+			fv = fv.Elem()
+		}
+		v = fv
+	}
+	return nil
+}
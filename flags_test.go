@@ -0,0 +1,204 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"bytes"
+	"flag"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type flagServer struct {
+	Host string `ucl:"host" usage:"address to listen on"`
+	Port int    `ucl:"port,default=8080" usage:"port to listen on"`
+}
+
+type flagConfig struct {
+	Name    string      `ucl:"name" usage:"application name"`
+	Verbose bool        `ucl:"verbose"`
+	Tags    []string    `ucl:"tags" usage:"tags, repeatable"`
+	Server  flagServer  `ucl:"server"`
+	Backup  *flagServer `ucl:"backup"`
+	Extra   map[string] interface{} `ucl:"extra"`
+}
+
+func TestBindFlags(t *testing.T) {
+	s := `
+name = app;
+tags = [a, b];
+server {
+	host = localhost;
+}
+`
+	p := NewParserFlags(strings.NewReader(s), ParseNumbers)
+	ucl, err := p.Ucl()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var cfg flagConfig
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.SetOutput(new(bytes.Buffer))
+	b, err := BindFlags(fs, &cfg, "ucl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fs.Lookup("extra") != nil {
+		t.Errorf("map field bound")
+	}
+	f := fs.Lookup("server.port")
+	if f == nil || f.Usage != "port to listen on" || f.DefValue != "8080" {
+		t.Fatalf("server.port: got %+v", f)
+	}
+	if fs.Lookup("backup.host") == nil {
+		t.Errorf("backup.host not bound")
+	}
+
+	err = fs.Parse([]string{"-verbose", "-server.port", "9000", "-tags", "x",
+	                        "-tags=y", "-backup.host=b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Decode(ucl, &cfg, "ucl"); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Apply(); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := flagConfig{
+		Name: "app",
+		Verbose: true,
+		Tags: []string{"x", "y"},
+		Server: flagServer{Host: "localhost", Port: 9000},
+		Backup: &flagServer{Host: "b", Port: 8080},
+	}
+	if !reflect.DeepEqual(cfg, expect) {
+		t.Errorf("got %+v, expected %+v", cfg, expect)
+	}
+
+	errors := map[string] []string{
+		"server.port": []string{"-server.port=x"},
+		"verbose":     []string{"-verbose=maybe"},
+	}
+	for name, args := range errors {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.SetOutput(new(bytes.Buffer))
+		if _, err := BindFlags(fs, &flagConfig{}, "ucl"); err != nil {
+			t.Fatal(err)
+		}
+		if err := fs.Parse(args); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+
+	if _, err := BindFlags(fs, cfg, "ucl"); err == nil {
+		t.Errorf("expected error binding a non-pointer")
+	}
+}
+
+func TestBindFlagsCycle(t *testing.T) {
+	type node struct {
+		Name string `ucl:"name"`
+		Next *node  `ucl:"next"`
+	}
+	type list struct {
+		Head node  `ucl:"head"`
+		Tail *node `ucl:"tail"`
+	}
+
+	var l list
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	if _, err := BindFlags(fs, &l, "ucl"); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) {
+		names = append(names, f.Name)
+	})
+	if !reflect.DeepEqual(names, []string{"head.name", "tail.name"}) {
+		t.Errorf("got flags %v", names)
+	}
+
+	// and through an embedded pointer, which is left nil until set
+	var s SelfEmbed
+	fs = flag.NewFlagSet("test", flag.ContinueOnError)
+	b, err := BindFlags(fs, &s, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names = nil
+	fs.VisitAll(func(f *flag.Flag) {
+		names = append(names, f.Name)
+	})
+	if !reflect.DeepEqual(names, []string{"x"}) {
+		t.Errorf("got flags %v", names)
+	}
+	if err = fs.Parse([]string{"-x=4"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = b.Apply(); err != nil || s.X != 4 || s.SelfEmbed != nil {
+		t.Errorf("got %+v, %v", s, err)
+	}
+}
+
+func TestBindFlagsValidate(t *testing.T) {
+	type backend struct {
+		Host string `ucl:"host" validate:"required"`
+		Port int    `ucl:"port" validate:"max=100"`
+	}
+	var cfg struct {
+		Port    int      `ucl:"port" validate:"max=100"`
+		Level   string   `ucl:"level" validate:"oneof=debug info"`
+		Backend *backend `ucl:"backend"`
+	}
+	if err := Decode(parseString(t, "port = 80;"), &cfg, "ucl"); err != nil {
+		t.Fatal(err)
+	}
+
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	b, err := BindFlags(fs, &cfg, "ucl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = fs.Parse([]string{"-port=99999", "-level=trace", "-backend.port=8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Apply()
+	if _, ok := err.(ValidationErrors); !ok || err.Error() !=
+	   "level must be one of debug, info; port must be at most 100" {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if cfg.Backend == nil || cfg.Backend.Port != 8 {
+		t.Errorf("backend: got %+v", cfg.Backend)
+	}
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Resolves ${path.to.key} references in string values, once the document
+// is parsed. A value that is only a reference becomes a copy of the value
+// referred to, keeping its type; otherwise the referenced value must be a
+// scalar, and is substituted as text. "$${" is a literal "${".
+type resolver struct {
+	p      *Parser
+	active map[string] bool // values being resolved, to detect cycles
+	done   map[string] bool
+	copied map[string] bool // values copied from resolved ones
+}
+
+func (p *Parser) interpolate() error {
+	r := &resolver{
+		p: p,
+		active: make(map[string] bool),
+		done: make(map[string] bool),
+		copied: make(map[string] bool),
+	}
+	_, err := r.resolve(p.ucl, "")
+	return err
+}
+
+// The location of the value at path, for errors
+func (r *resolver) where(path string) string {
+	if o, ok := r.p.Origin(path); ok {
+		return " at " + o.String()
+	}
+	return ""
+}
+
+// Resolve the references within v, found at path, returning its new value
+func (r *resolver) resolve(v interface{}, path string) (interface{}, error) {
+	if r.done[path] {
+		return v, nil
+	}
+	for i := range path {
+		if (path[i] == '.' || path[i] == '[') && r.copied[path[:i]] {
+			return v, nil
+		}
+	}
+	r.active[path] = true
+
+	var err error
+	switch cv := v.(type) {
+	case map[string] interface{}:
+		keys, _ := cv[KeyOrder].([]string)
+		if keys == nil {
+			for k := range cv {
+				if k != KeyOrder {
+					keys = append(keys, k)
+				}
+			}
+			sort.Strings(keys)
+		}
+		for _, k := range keys {
+			if cv[k], err = r.resolve(cv[k], joinPath(path, k)); err != nil {
+				return nil, err
+			}
+		}
+	case []interface{}:
+		for i := range cv {
+			cpath := path + "[" + strconv.Itoa(i) + "]"
+			if cv[i], err = r.resolve(cv[i], cpath); err != nil {
+				return nil, err
+			}
+		}
+	case string:
+		if v, err = r.expand(cv, path); err != nil {
+			return nil, err
+		}
+		if _, ok := v.(string); !ok {
+			r.copied[path] = true
+		}
+	}
+
+	delete(r.active, path)
+	r.done[path] = true
+	return v, nil
+}
+
+// The value of a reference made from path, resolving it first
+func (r *resolver) lookup(ref, path string) (interface{}, error) {
+	if r.active[ref] {
+		return nil, fmt.Errorf("reference ${%s} in %s is cyclic%s", ref,
+		                       path, r.where(path))
+	}
+	parent, key, index, v, ok := r.p.findPath(ref)
+	if !ok {
+		return nil, fmt.Errorf("unresolved reference ${%s} in %s%s", ref,
+		                       path, r.where(path))
+	}
+	v, err := r.resolve(v, ref)
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := parent.(map[string] interface{}); ok {
+		m[key] = v
+	} else {
+		parent.([]interface{})[index] = v
+	}
+	return v, nil
+}
+
+// Substitute the references in s, the value at path
+func (r *resolver) expand(s, path string) (interface{}, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+
+	// a value that is only a reference takes its type
+	if strings.HasPrefix(s, "${") && strings.Index(s, "}") == len(s) - 1 {
+		v, err := r.lookup(s[2:len(s)-1], path)
+		if err != nil {
+			return nil, err
+		}
+		return r.p.copyValue(v), nil
+	}
+
+	var buf strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			buf.WriteString(s)
+			break
+		}
+		if i > 0 && s[i-1] == '$' {
+			// $${ is a literal ${
+			buf.WriteString(s[:i-1] + "${")
+			s = s[i+2:]
+			continue
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated reference in %s%s", path,
+			                       r.where(path))
+		}
+		ref := s[i+2:i+end]
+		v, err := r.lookup(ref, path)
+		if err != nil {
+			return nil, err
+		}
+
+		buf.WriteString(s[:i])
+		switch v := v.(type) {
+		case string:
+			buf.WriteString(v)
+		case map[string] interface{}, []interface{}:
+			return nil, fmt.Errorf("reference ${%s} in %s is not a scalar%s",
+			                       ref, path, r.where(path))
+		case float64:
+			buf.WriteString(formatFloat(v, 64))
+		case nil:
+		default:
+			buf.WriteString(fmt.Sprint(v))
+		}
+		s = s[i+end+1:]
+	}
+	return buf.String(), nil
+}
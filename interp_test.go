@@ -0,0 +1,128 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestReferences(t *testing.T) {
+	s := `
+root = /srv/app;
+logs = ${root}/logs;
+port = 8080;
+url = "http://localhost:${port}/";
+listen = ${port}
+db { host = db1; }
+primary = ${db}
+backup { host = "${db.host}-backup" }
+servers [ a, "${servers[0]}b" ]
+price = "$${5}";
+alias = ${price}
+forward = "${later}!"
+later = "${logs}"
+`
+	p := NewParserFlags(strings.NewReader(s), ParseNumbers | ParseReferences)
+	ucl, err := p.Ucl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string] interface{}{
+		"logs":    "/srv/app/logs",
+		"url":     "http://localhost:8080/",
+		"listen":  int64(8080),
+		"primary": map[string] interface{}{KeyOrder: []string{"host"},
+		                                    "host": "db1"},
+		"backup":  map[string] interface{}{KeyOrder: []string{"host"},
+		                                    "host": "db1-backup"},
+		"servers": []interface{}{"a", "ab"},
+		"price":   "${5}",
+		"alias":   "${5}",
+		"forward": "/srv/app/logs!",
+	}
+	for k, v := range expect {
+		if !reflect.DeepEqual(ucl[k], v) {
+			t.Errorf("%s: got %#v, want %#v", k, ucl[k], v)
+		}
+	}
+
+	// the copy is separate, and keeps its origin
+	ucl["primary"].(map[string] interface{})["host"] = "x"
+	if ucl["db"].(map[string] interface{})["host"] != "db1" {
+		t.Errorf("db changed through reference copy")
+	}
+	if o, ok := p.Origin("primary.host"); !ok || o.Line != 7 {
+		t.Errorf("origin of primary.host: got %v", o)
+	}
+
+	// without the flag, references are left alone
+	ucl, err = NewParser(strings.NewReader("a = 1; b = ${a}\n")).Ucl()
+	if err != nil || ucl["b"] != "${a}" {
+		t.Errorf("without ParseReferences: got %v, %v", ucl, err)
+	}
+
+	// nor is loaded text
+	fsys := fstest.MapFS{
+		"app.conf": {Data: []byte(`
+table = users;
+.load(key=query) "query.sql"
+q = "${query}"
+`)},
+		"query.sql": {Data: []byte("select * from ${table} where x = '$${y}'\n")},
+	}
+	p, err = NewFSParser(fsys, "app.conf", ParseReferences)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ucl, err = p.Ucl(); err != nil {
+		t.Fatal(err)
+	}
+	want := "select * from ${table} where x = '$${y}'"
+	if ucl["query"] != want || ucl["q"] != want {
+		t.Errorf("loaded: got %q, %q", ucl["query"], ucl["q"])
+	}
+
+	errors := map[string] string{
+		"a = 1;\nb = \"x${c}\"":      "unresolved reference ${c} in b at <input>:2:1",
+		"a = ${b}\nb = ${a}":         "reference ${a} in b is cyclic at <input>:2:1",
+		"a { b = \"${a}\" }":         "reference ${a} in a.b is cyclic",
+		"a { b = 1 }\nc = \"x${a}\"": "reference ${a} in c is not a scalar",
+		"a = \"${b\"":                "unterminated reference in a",
+	}
+	for s, msg := range errors {
+		_, err := NewParserFlags(strings.NewReader(s + "\n"),
+		                         ParseReferences).Ucl()
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%s: got error %v, want %q", s, err, msg)
+		}
+	}
+}
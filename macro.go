@@ -0,0 +1,707 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// How deeply .include, and macros that parse content, may nest, which
+// stops a file including itself
+const maxIncludeDepth = 16
+
+// A .name(params) key that the parser handles itself, e.g.
+//   .include(try=true) "extra.conf"
+//   .load(key=cert, multiline=true) "cert.pem"
+type macroCall struct {
+	name   string
+	params map[string] interface{}
+	line   int
+	col    int
+}
+
+type macroFunc func(p *Parser, m *macroCall, parent map[string] interface{},
+                    arg interface{}) error
+
+var macros map[string] macroFunc
+
+func init() {
+	macros = map[string] macroFunc{
+		"include": (*Parser).include,
+		"inherit": (*Parser).inherit,
+		"load":    (*Parser).load,
+	}
+}
+
+// Return the macro named by a key tag, or nil if the key is not one; keys
+// starting with '.' that are not known macros are kept as ordinary keys.
+func (p *Parser) parseMacro(t *tag) (*macroCall, error) {
+	k := string(t.val)
+	if len(k) < 2 || k[0] != '.' {
+		return nil, nil
+	}
+
+	name := k[1:]
+	params := ""
+	if i := strings.IndexByte(name, '('); i >= 0 {
+		params = name[i+1:]
+		name = name[:i]
+		if !strings.HasSuffix(params, ")") {
+			if p.macro(name) != nil {
+				return nil, fmt.Errorf("unterminated parameters for .%s at line %d",
+				                       name, t.line)
+			}
+			return nil, nil
+		}
+		params = params[:len(params)-1]
+	}
+	if p.macro(name) == nil {
+		return nil, nil
+	}
+
+	m := &macroCall{name: name, line: t.line, col: t.col}
+	if strings.TrimSpace(params) != "" {
+		var err error
+		r := strings.NewReader("{" + params + "\n}")
+		m.params, err = NewParser(r).Ucl()
+		if err != nil {
+			return nil, fmt.Errorf("invalid parameters for .%s at line %d: %v",
+			                       name, t.line, err)
+		}
+	}
+	return m, nil
+}
+
+func (p *Parser) runMacro(m *macroCall, parent map[string] interface{},
+                          arg interface{}) error {
+	return p.macro(m.name)(p, m, parent, arg)
+}
+
+// The handler of a macro, registered or built in
+func (p *Parser) macro(name string) macroFunc {
+	if f, ok := p.macros[name]; ok {
+		return f
+	}
+	return macros[name]
+}
+
+// A macro's parameters, as in .name(key=value, ...)
+type Object map[string] interface{}
+
+// A parsed value: a string, or a typed value (see NewParserFlags),
+// map[string] interface{}, []interface{} or nil
+type Node interface{}
+
+// Handles a macro, with its parameters and the value following it, or
+// returns an error to reject it
+type MacroFunc func(ctx MacroContext, args Object, body Node) error
+
+// Where a macro appears, and what it may do there
+type MacroContext struct {
+	p      *Parser
+	m      *macroCall
+	parent map[string] interface{}
+}
+
+// Handle .name directives with fn, in place of any built in macro. Files
+// that this parser includes also use fn.
+func (p *Parser) RegisterMacro(name string, fn MacroFunc) {
+	if p.macros == nil {
+		p.macros = make(map[string] macroFunc)
+	}
+	p.macros[name] = func(p *Parser, m *macroCall,
+	                      parent map[string] interface{}, arg interface{}) error {
+		err := fn(MacroContext{p, m, parent}, Object(m.params), Node(arg))
+		if err != nil {
+			return fmt.Errorf(".%s: %v at line %d", m.name, err, m.line)
+		}
+		return nil
+	}
+}
+
+// The macro's name, without the '.'
+func (ctx MacroContext) Name() string {
+	return ctx.m.name
+}
+
+// Where the macro appears
+func (ctx MacroContext) Origin() Origin {
+	return *ctx.p.macroOrigin(ctx.m)
+}
+
+// The object that the macro is in
+func (ctx MacroContext) Object() map[string] interface{} {
+	return ctx.parent
+}
+
+// Set key in the object the macro is in, as if it were parsed there
+func (ctx MacroContext) Set(key string, v interface{}) error {
+	return ctx.p.addValue(ctx.parent, key, v, ctx.p.macroOrigin(ctx.m))
+}
+
+// Parse UCL data into the object the macro is in, as .include would
+func (ctx MacroContext) Parse(data []byte) error {
+	return ctx.p.parseInto(ctx.m, ctx.parent, data, "." + ctx.m.name, "",
+	                       ctx.p.priority)
+}
+
+// Read a file, or URL, relative to the file being parsed; it must be
+// within the root as for .include
+func (ctx MacroContext) ReadFile(name string) ([]byte, error) {
+	loc, err := ctx.p.resolve(name)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.p.readLoc(loc)
+}
+
+func (m *macroCall) stringParam(name, def string) (string, error) {
+	v, ok := m.params[name]
+	if !ok {
+		return def, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf(".%s parameter %s must be a string at line %d",
+		                      m.name, name, m.line)
+	}
+	return s, nil
+}
+
+func (m *macroCall) boolParam(name string, def bool) (bool, error) {
+	s, err := m.stringParam(name, "")
+	if err != nil || s == "" {
+		return def, err
+	}
+	b, err := parseBool(s)
+	if err != nil {
+		return false, fmt.Errorf(".%s parameter %s must be a boolean at line %d",
+		                         m.name, name, m.line)
+	}
+	return b, nil
+}
+
+// The file name a macro was given
+func (m *macroCall) filename(arg interface{}) (string, error) {
+	s, ok := arg.(string)
+	if !ok || s == "" {
+		return "", fmt.Errorf(".%s requires a file name at line %d",
+		                      m.name, m.line)
+	}
+	return s, nil
+}
+
+// Open the OS directory that files read by macros must be within, unless
+// an fs.FS was given. A parser of a reader has no directory of its own,
+// and its input may not be trusted to read the working directory, so it
+// reads no files until given one.
+func (p *Parser) openRoot() error {
+	if p.fsys != nil {
+		return nil
+	}
+	if p.root == "" && p.osfile == "" {
+		return fmt.Errorf("no directory to read files from " +
+		                  "(see Parser.SetRoot and Parser.SetFS)")
+	}
+
+	root := p.root
+	if root == "" {
+		root = filepath.Dir(p.osfile)
+	}
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	if r, err := filepath.EvalSymlinks(root); err == nil {
+		root = r
+	}
+
+	p.dir = "."
+	if p.osfile != "" {
+		dir, err := filepath.Abs(filepath.Dir(p.osfile))
+		if err != nil {
+			return err
+		}
+		if r, err := filepath.EvalSymlinks(dir); err == nil {
+			dir = r
+		}
+		if dir, err = filepath.Rel(root, dir); err != nil ||
+		   !fs.ValidPath(filepath.ToSlash(dir)) {
+			return fmt.Errorf("%s is outside of %s", p.osfile, root)
+		}
+		p.dir = filepath.ToSlash(dir)
+	}
+	p.fsys = os.DirFS(root)
+	p.osroot = root
+	return nil
+}
+
+// Resolve a file named by a macro to a path in p.fsys, relative to the file
+// being parsed. A path starting with '/' is from the root of an fs.FS, or is
+// an OS path. It, and for the OS any symlinks along the way, must stay
+// within the root. URLs, and names within a file read from a URL, resolve
+// to a URL.
+func (p *Parser) resolve(name string) (string, error) {
+	if isURL(name) || p.base != nil {
+		return p.resolveURL(name)
+	}
+	if err := p.openRoot(); err != nil {
+		return "", err
+	}
+	rootname := p.osroot
+	if rootname == "" {
+		rootname = "the root"
+	}
+	outside := fmt.Errorf("%s is outside of %s", name, rootname)
+
+	var fpath string
+	switch {
+	case p.osroot != "" && filepath.IsAbs(name):
+		rel, err := filepath.Rel(p.osroot, name)
+		if err != nil {
+			return "", outside
+		}
+		fpath = filepath.ToSlash(rel)
+	case p.osroot == "" && strings.HasPrefix(name, "/"):
+		fpath = strings.TrimLeft(name, "/")
+	default:
+		fpath = path.Join(p.dir, filepath.ToSlash(name))
+	}
+	fpath = path.Clean(fpath)
+	if !fs.ValidPath(fpath) {
+		return "", outside
+	}
+
+	if p.osroot != "" {
+		real, err := filepath.EvalSymlinks(filepath.Join(p.osroot,
+		                                   filepath.FromSlash(fpath)))
+		if err == nil {
+			rel, err := filepath.Rel(p.osroot, real)
+			if err != nil || !fs.ValidPath(filepath.ToSlash(rel)) {
+				return "", outside
+			}
+		}
+	}
+	return fpath, nil
+}
+
+// Read a file named by a macro. A missing or unreadable file returns nil
+// data and no error if the macro has try=true.
+func (p *Parser) readFile(m *macroCall, arg interface{}) (string, []byte, error) {
+	try, err := m.boolParam("try", false)
+	if err != nil {
+		return "", nil, err
+	}
+	name, err := m.filename(arg)
+	if err != nil {
+		return "", nil, err
+	}
+	fpath, err := p.resolve(name)
+	if err != nil {
+		return "", nil, fmt.Errorf(".%s: %v at line %d", m.name, err, m.line)
+	}
+	data, err := p.readLoc(fpath)
+	if err != nil {
+		if try {
+			return fpath, nil, nil
+		}
+		return "", nil, fmt.Errorf(".%s: %v at line %d", m.name, err, m.line)
+	}
+	if err = p.verify(m, fpath, data); err != nil {
+		return "", nil, fmt.Errorf(".%s: %s %v at line %d", m.name, name, err,
+		                           m.line)
+	}
+	return fpath, data, nil
+}
+
+// Read a path resolved by resolve()
+func (p *Parser) readLoc(loc string) ([]byte, error) {
+	if isURL(loc) {
+		return p.fetch(loc)
+	}
+	return fs.ReadFile(p.fsys, loc)
+}
+
+// Check the integrity of a file read by a macro: sha256="hex" must match
+// its digest, and sign=true requires fpath.sig to hold an ed25519
+// signature of it, raw or base64 encoded, by one of the parser's keys.
+func (p *Parser) verify(m *macroCall, fpath string, data []byte) error {
+	sum, err := m.stringParam("sha256", "")
+	if err != nil {
+		return err
+	}
+	if sum != "" {
+		want, err := hex.DecodeString(sum)
+		if err != nil || len(want) != sha256.Size {
+			return fmt.Errorf("has invalid sha256 parameter %q", sum)
+		}
+		got := sha256.Sum256(data)
+		if !bytes.Equal(got[:], want) {
+			return fmt.Errorf("does not match sha256 %s", sum)
+		}
+	}
+
+	sign, err := m.boolParam("sign", false)
+	if err != nil || !sign {
+		return err
+	}
+	if len(p.keys) == 0 {
+		return fmt.Errorf("cannot be verified, as no keys are set")
+	}
+	sig, err := p.readLoc(fpath + ".sig")
+	if err != nil {
+		return fmt.Errorf("signature: %v", err)
+	}
+	if len(sig) != ed25519.SignatureSize {
+		b, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(sig)))
+		if err != nil || len(b) != ed25519.SignatureSize {
+			return fmt.Errorf("has a malformed signature")
+		}
+		sig = b
+	}
+	for _, key := range p.keys {
+		if ed25519.Verify(key, data, sig) {
+			return nil
+		}
+	}
+	return fmt.Errorf("has a bad signature")
+}
+
+// .include(try=bool, sha256=hex, sign=bool, priority=int) "file" parses
+// file into the enclosing object. Its values replace those of a lower
+// priority, and are ignored where there are ones of a higher priority;
+// the priority is otherwise that of the including file.
+func (p *Parser) include(m *macroCall, parent map[string] interface{},
+                         arg interface{}) error {
+	priority := p.priority
+	if s, err := m.stringParam("priority", ""); err != nil {
+		return err
+	} else if s != "" {
+		if priority, err = strconv.Atoi(s); err != nil {
+			return fmt.Errorf(".include parameter priority must be an int at line %d",
+			                  m.line)
+		}
+	}
+
+	fpath, data, err := p.readFile(m, arg)
+	if err != nil || data == nil {
+		return err
+	}
+	return p.parseInto(m, parent, data, p.locName(fpath), fpath, priority)
+}
+
+// Parse data, from a macro, into parent. name is shown in origins and
+// errors, and loc is the resolved location of data, if any.
+func (p *Parser) parseInto(m *macroCall, parent map[string] interface{},
+                           data []byte, name, loc string, priority int) error {
+	if p.depth >= maxIncludeDepth {
+		return fmt.Errorf(".%s of %s nested too deeply at line %d",
+		                  m.name, name, m.line)
+	}
+
+	dir := p.dir
+	if loc != "" {
+		dir = path.Dir(loc)
+	}
+	child := &Parser{
+		scanner: newScanner(bytes.NewReader(data)),
+		ucl: parent,
+		flags: p.flags,
+		fsys: p.fsys,
+		dir: dir,
+		osroot: p.osroot,
+		keys: p.keys,
+		http: p.http,
+		base: p.base,
+		depth: p.depth + 1,
+		origins: p.origins,
+		stack: p.stack[:len(p.stack):len(p.stack)],
+		macros: p.macros,
+		name: name,
+		chain: append(p.chain[:len(p.chain):len(p.chain)],
+		              fmt.Sprintf("%s:%d", p.locName(""), m.line)),
+		priority: priority,
+	}
+	if isURL(loc) {
+		var err error
+		if child.base, err = url.Parse(loc); err != nil {
+			return err
+		}
+	}
+	if _, err := child.Ucl(); err != nil {
+		return fmt.Errorf("%s: %v", child.name, err)
+	}
+	return nil
+}
+
+// .inherit "name" copies the keys of the object name into the enclosing
+// object, where keys it sets itself, before or after, take precedence. name
+// is looked up among the already parsed siblings of the object, then those
+// of each object enclosing it.
+func (p *Parser) inherit(m *macroCall, parent map[string] interface{},
+                         arg interface{}) error {
+	name, ok := arg.(string)
+	if !ok || name == "" {
+		return fmt.Errorf(".inherit requires an object name at line %d", m.line)
+	}
+	v, ok := p.template(name)
+	if !ok {
+		// the object itself, or one enclosing it, is not yet complete
+		for _, k := range p.stack {
+			if k == name {
+				return fmt.Errorf(".inherit of %q is cyclic at line %d",
+				                  name, m.line)
+			}
+		}
+		return fmt.Errorf(".inherit of %q: no such object at line %d",
+		                  name, m.line)
+	}
+	tmpl, ok := v.(map[string] interface{})
+	if !ok {
+		return fmt.Errorf(".inherit of %q: not a single object at line %d",
+		                  name, m.line)
+	}
+	for _, f := range p.stack {
+		if fm, ok := f.(map[string] interface{}); ok &&
+		   reflect.ValueOf(fm).Pointer() == reflect.ValueOf(tmpl).Pointer() {
+			return fmt.Errorf(".inherit of %q is cyclic at line %d",
+			                  name, m.line)
+		}
+	}
+
+	keys, _ := tmpl[KeyOrder].([]string)
+	if keys == nil {
+		for k := range tmpl {
+			if k != KeyOrder {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+	}
+	for _, k := range keys {
+		if _, ok := parent[k]; ok {
+			continue
+		}
+		var o *Origin
+		if ol := p.origins[mapOriginKey(tmpl, k)].origins; len(ol) > 0 {
+			c := *ol[len(ol)-1]
+			o = &c
+		} else {
+			o = p.macroOrigin(m)
+		}
+		if err := p.addValue(parent, k, p.copyValue(tmpl[k]), o); err != nil {
+			return err
+		}
+		key := mapOriginKey(parent, k)
+		r := p.origins[key]
+		r.inherited = true
+		p.origins[key] = r
+	}
+	return nil
+}
+
+// Find the value that .inherit names. p.stack ends with the object the
+// macro is in, and the keys before each object lead to it from the
+// previous one, through values that may already hold its siblings.
+func (p *Parser) template(name string) (interface{}, bool) {
+	var keys []string
+	for i := len(p.stack) - 2; i >= 0; i-- {
+		k, ok := p.stack[i+1].(string)
+		if ok {
+			keys = append([]string{k}, keys...)
+		}
+		if _, ok := p.stack[i].(map[string] interface{}); !ok ||
+		   len(keys) == 0 {
+			continue
+		}
+
+		// the values along keys, except the last which names the object
+		// itself, hold its siblings; the innermost are searched first
+		vals := []interface{}{p.stack[i]}
+		for _, k := range keys[:len(keys)-1] {
+			v, ok := lookupIn(vals[len(vals)-1], k)
+			if !ok {
+				break
+			}
+			vals = append(vals, v)
+		}
+		for j := len(vals) - 1; j >= 0; j-- {
+			if v, ok := lookupIn(vals[j], name); ok {
+				return v, true
+			}
+		}
+		keys = keys[:0]
+	}
+	return nil, false
+}
+
+// Look up key k in an object, or the last of an array of objects that has
+// it, as repeated sections are
+func lookupIn(v interface{}, k string) (interface{}, bool) {
+	switch v := v.(type) {
+	case map[string] interface{}:
+		cv, ok := v[k]
+		return cv, ok
+	case []interface{}:
+		for i := len(v) - 1; i >= 0; i-- {
+			if m, ok := v[i].(map[string] interface{}); ok {
+				if cv, ok := m[k]; ok {
+					return cv, true
+				}
+			}
+		}
+	}
+	return nil, false
+}
+
+// Deep copy an inherited value, along with the origins of its parts
+func (p *Parser) copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string] interface{}:
+		n := make(map[string] interface{}, len(v))
+		for k, cv := range v {
+			if k == KeyOrder {
+				if ko, ok := cv.([]string); ok {
+					n[k] = append([]string(nil), ko...)
+					continue
+				}
+			}
+			n[k] = p.copyValue(cv)
+			p.setMapOrigins(n, k, p.copyOrigins(mapOriginKey(v, k)))
+		}
+		return n
+	case []interface{}:
+		n := make([]interface{}, len(v))
+		for i := range v {
+			n[i] = p.copyValue(v[i])
+		}
+		for i := range v {
+			p.setListOrigins(n, i, p.copyOrigins(listOriginKey(v, i)))
+		}
+		return n
+	}
+	return v
+}
+
+// The name of a resolved path for people, or of the file being parsed
+func (p *Parser) locName(loc string) string {
+	switch {
+	case loc == "" && p.name == "":
+		return "<input>"
+	case loc == "":
+		return p.name
+	case p.osroot != "" && !isURL(loc):
+		return filepath.Join(p.osroot, filepath.FromSlash(loc))
+	}
+	return loc
+}
+
+// The origin of a value set by a macro
+func (p *Parser) macroOrigin(m *macroCall) *Origin {
+	return p.origin(&tag{line: m.line, col: m.col})
+}
+
+// .load(key=name, target=string|int, multiline=bool, escape=bool,
+// try=bool, sha256=hex, sign=bool) "file" sets key to the contents of file.
+// Unless multiline, the trailing line break is removed, and escape gives
+// the contents with JSON string escapes. The contents are taken literally,
+// without ParseReferences substitutions.
+func (p *Parser) load(m *macroCall, parent map[string] interface{},
+                      arg interface{}) error {
+	key, err := m.stringParam("key", "")
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return fmt.Errorf(".load requires a key parameter at line %d", m.line)
+	}
+	target, err := m.stringParam("target", "string")
+	if err != nil {
+		return err
+	}
+	multiline, err := m.boolParam("multiline", false)
+	if err != nil {
+		return err
+	}
+	escape, err := m.boolParam("escape", false)
+	if err != nil {
+		return err
+	}
+
+	_, data, err := p.readFile(m, arg)
+	if err != nil || data == nil {
+		return err
+	}
+
+	s := string(data)
+	if !multiline {
+		s = strings.TrimRight(s, "\r\n")
+	}
+	if escape {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		enc.Encode(s)
+		s = strings.TrimSuffix(buf.String(), "\n")
+		s = s[1:len(s)-1]
+	}
+
+	switch target {
+	case "string":
+		if p.flags & ParseReferences != 0 {
+			// escaped, so interpolation gives back the text as loaded
+			s = strings.Replace(s, "${", "$${", -1)
+		}
+		return p.addValue(parent, key, s, p.macroOrigin(m))
+	case "int":
+		n, err := strconv.ParseInt(strings.TrimSpace(s), 0, 64)
+		if err != nil {
+			return fmt.Errorf(".load of %s: invalid int at line %d",
+			                  arg, m.line)
+		}
+		return p.addValue(parent, key, n, p.macroOrigin(m))
+	}
+	return fmt.Errorf(".load target %q is not string or int at line %d",
+	                  target, m.line)
+}
@@ -0,0 +1,431 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// Write files, given by path relative to dir, with their contents
+func writeFiles(t *testing.T, dir string, files map[string] string) {
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMacros(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ucltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cert := "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"
+	writeFiles(t, dir, map[string] string{
+		"conf/main.conf": `
+name = main;
+.include "sub/inc.conf"
+tls {
+	.load(key=cert, multiline=true) "certs/cert.pem";
+	.load(key = "port", target = int) "port.txt" }
+.load(key=missing, try=true) "nothere"
+.include(try=yes) "nothere.conf"
+.load(key=quoted, escape=true) "quote.txt"
+.unknown = kept;
+`,
+		"conf/sub/inc.conf": "name = inc;\n.load(key=sql) \"../query.sql\"\n",
+		"conf/certs/cert.pem": cert,
+		"conf/port.txt": "8443\n",
+		"conf/query.sql": "SELECT 1;\n\n",
+		"conf/quote.txt": "say \"hi\"\tnow\n",
+		"conf/escape.conf": ".include \"../secret.conf\"\n",
+		"conf/loop.conf": ".include \"loop.conf\"\n",
+		"conf/link.conf": ".load(key=x) \"link\"\n",
+		"secret.conf": "secret = 1;\n",
+	})
+	os.Symlink(filepath.Join(dir, "secret.conf"),
+	           filepath.Join(dir, "conf", "link"))
+
+	p, err := NewFileParser(filepath.Join(dir, "conf", "main.conf"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ucl, err := p.Ucl()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string] interface{}{
+		"name": []interface{}{"main", "inc"},
+		"sql": "SELECT 1;",
+		"tls": map[string] interface{}{
+			KeyOrder: []string{"cert", "port"},
+			"cert": cert,
+			"port": int64(8443),
+		},
+		"quoted": `say \"hi\"\tnow`,
+		".unknown": "kept",
+	}
+	for k, v := range expect {
+		if !reflect.DeepEqual(ucl[k], v) {
+			t.Errorf("%s: got %#v, want %#v", k, ucl[k], v)
+		}
+	}
+	if _, ok := ucl["missing"]; ok {
+		t.Errorf("missing: got %v", ucl["missing"])
+	}
+
+	errors := map[string] string{
+		"escape.conf": "secret.conf is outside of",
+		"loop.conf":   "nested too deeply",
+		"link.conf":   "link is outside of",
+	}
+	for name, msg := range errors {
+		p, err := NewFileParser(filepath.Join(dir, "conf", name), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = p.Ucl(); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%s: got error %v, want %q", name, err, msg)
+		}
+	}
+
+	// widening the root allows the include
+	p, _ = NewFileParser(filepath.Join(dir, "conf", "escape.conf"), 0)
+	p.SetRoot(dir)
+	if ucl, err = p.Ucl(); err != nil || ucl["secret"] != "1" {
+		t.Errorf("escape.conf with root: got %v, %v", ucl, err)
+	}
+
+	// a reader reads no files, not even from the working directory,
+	// until given a root
+	writeFiles(t, dir, map[string] string{"token": "abc\n"})
+	for _, s := range []string{".load(key=x) \"token\"", ".include \"token\""} {
+		p = NewParser(strings.NewReader(s + "\n"))
+		_, err = p.Ucl()
+		if err == nil || !strings.Contains(err.Error(),
+		                                   "no directory to read files from") {
+			t.Errorf("%s: got error %v", s, err)
+		}
+	}
+	p = NewParser(strings.NewReader(".load(key=x) \"token\"\n"))
+	p.SetRoot(dir)
+	if ucl, err = p.Ucl(); err != nil || ucl["x"] != "abc" {
+		t.Errorf("reader with root: got %v, %v", ucl, err)
+	}
+}
+
+func TestMacrosFS(t *testing.T) {
+	fsys := fstest.MapFS{
+		"etc/app.conf": {Data: []byte(`
+.include "conf.d/db.conf"
+.include "/shared/common.conf"
+.load(key=motd) "../motd.txt"
+`)},
+		"etc/conf.d/db.conf": {Data: []byte("db { .load(key=dsn) \"dsn\" }\n")},
+		"etc/conf.d/dsn": {Data: []byte("postgres://db/app\n")},
+		"shared/common.conf": {Data: []byte("level = debug;\n")},
+		"motd.txt": {Data: []byte("hello\n")},
+		"etc/bad.conf": {Data: []byte(".include \"../../x.conf\"\n")},
+	}
+
+	p, err := NewFSParser(fsys, "etc/app.conf", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ucl, err := p.Ucl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := ucl["db"].(map[string] interface{})
+	if db == nil || db["dsn"] != "postgres://db/app" ||
+	   ucl["level"] != "debug" || ucl["motd"] != "hello" {
+		t.Errorf("unexpected result %v", ucl)
+	}
+
+	p, _ = NewFSParser(fsys, "etc/bad.conf", 0)
+	if _, err = p.Ucl(); err == nil ||
+	   !strings.Contains(err.Error(), "../../x.conf is outside of") {
+		t.Errorf("bad.conf: got error %v", err)
+	}
+
+	// a reader given an fs.FS and base directory
+	p = NewParser(strings.NewReader(".include \"dsn\"\n"))
+	p.SetFS(fstest.MapFS{"defaults/dsn": {Data: []byte("dsn = x;\n")}},
+	        "defaults")
+	if ucl, err = p.Ucl(); err != nil || ucl["dsn"] != "x" {
+		t.Errorf("SetFS: got %v, %v", ucl, err)
+	}
+}
+
+func TestMacroIntegrity(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, _ := ed25519.GenerateKey(nil)
+
+	frag := []byte("port = 80;\n")
+	sum := sha256.Sum256(frag)
+	sig := ed25519.Sign(priv, frag)
+	fsys := fstest.MapFS{
+		"frag.conf":         {Data: frag},
+		"frag.conf.sig":     {Data: sig},
+		"b64.conf":          {Data: frag},
+		"b64.conf.sig":      {Data: []byte(base64.StdEncoding.EncodeToString(sig) + "\n")},
+		"tampered.conf":     {Data: []byte("port = 8080;\n")},
+		"tampered.conf.sig": {Data: sig},
+		"unsigned.conf":     {Data: frag},
+	}
+
+	tests := []struct {
+		include string
+		keys    []ed25519.PublicKey
+		err     string
+	}{
+		{`.include(sha256="` + hex.EncodeToString(sum[:]) + `") "frag.conf"`, nil, ""},
+		{`.include(sha256="` + strings.Repeat("00", 32) + `") "frag.conf"`, nil,
+		 "frag.conf does not match sha256"},
+		{`.include(sha256=abc) "frag.conf"`, nil, "invalid sha256 parameter"},
+		{`.include(sign=true) "frag.conf"`, []ed25519.PublicKey{other, pub}, ""},
+		{`.include(sign=true) "b64.conf"`, []ed25519.PublicKey{pub}, ""},
+		{`.include(sign=true) "frag.conf"`, []ed25519.PublicKey{other},
+		 "frag.conf has a bad signature"},
+		{`.include(sign=true) "tampered.conf"`, []ed25519.PublicKey{pub},
+		 "tampered.conf has a bad signature"},
+		{`.include(sign=true, try=true) "unsigned.conf"`, []ed25519.PublicKey{pub},
+		 "unsigned.conf signature:"},
+		{`.include(sign=true) "frag.conf"`, nil, "no keys are set"},
+	}
+	for _, tt := range tests {
+		p := NewParser(strings.NewReader(tt.include + "\n"))
+		p.SetFS(fsys, ".")
+		p.SetKeys(tt.keys...)
+		ucl, err := p.Ucl()
+		if tt.err == "" {
+			if err != nil || ucl["port"] != "80" {
+				t.Errorf("%s: got %v, %v", tt.include, ucl, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.include, err, tt.err)
+		}
+	}
+}
+
+func TestInherit(t *testing.T) {
+	s := `
+defaults {
+	timeout = 5;
+	tags [ a, b ];
+	tls { verify = yes; }
+}
+backends {
+	base {
+		.inherit "defaults"
+		port = 80;
+	}
+	web1 {
+		port = 8080;
+		.inherit "base"
+		timeout = 10;
+	}
+}
+section "blah" { key = value; }
+section "foo" { .inherit "blah"; other = 1; }
+`
+	p := NewParser(strings.NewReader(s))
+	ucl, err := p.Ucl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	backends := ucl["backends"].(map[string] interface{})
+	web1 := backends["web1"].(map[string] interface{})
+	if web1["port"] != "8080" || web1["timeout"] != "10" ||
+	   !reflect.DeepEqual(web1["tags"], []interface{}{"a", "b"}) {
+		t.Errorf("web1: got %v", web1)
+	}
+	base := backends["base"].(map[string] interface{})
+	if base["port"] != "80" || base["timeout"] != "5" {
+		t.Errorf("base: got %v", base)
+	}
+
+	// inherited values are copies
+	tls := web1["tls"].(map[string] interface{})
+	tls["verify"] = "no"
+	defaults := ucl["defaults"].(map[string] interface{})
+	if defaults["tls"].(map[string] interface{})["verify"] != "yes" {
+		t.Errorf("defaults changed through inherited copy")
+	}
+
+	sections := ucl["section"].([]interface{})
+	foo := sections[1].(map[string] interface{})["foo"].(map[string] interface{})
+	if foo["key"] != "value" || foo["other"] != "1" {
+		t.Errorf("section foo: got %v", foo)
+	}
+
+	// inherited values keep their origins, and are overridden locally
+	if o, _ := p.Origin("backends.web1.tags[1]"); o.Line != 4 {
+		t.Errorf("origin of inherited tags[1]: got %v", o)
+	}
+	if e := p.Explain("backends.web1.timeout"); len(e) != 2 ||
+	   !e[0].Overridden || e[0].Line != 3 || e[1].Line != 15 {
+		t.Errorf("explain web1.timeout: got %v", e)
+	}
+
+	// an earlier object of the same name is complete, so not cyclic
+	ucl, err = NewParser(strings.NewReader(
+	    "a { x = 1; }\na { b { .inherit \"a\" } }")).Ucl()
+	if err != nil {
+		t.Errorf("inherit of earlier a: %v", err)
+	} else if b := ucl["a"].([]interface{})[1].(map[string] interface{})["b"];
+	          b.(map[string] interface{})["x"] != "1" {
+		t.Errorf("inherit of earlier a: got %v", b)
+	}
+
+	errors := map[string] string{
+		"a { .inherit \"nope\" }":           `"nope": no such object at line 1`,
+		"a { b = 1; c { .inherit \"b\" } }": `"b": not a single object`,
+		"a { b { .inherit \"a\" } }":        `"a" is cyclic at line 1`,
+		"a { b { .inherit \"b\" } }":        `"b" is cyclic at line 1`,
+		"a { b { } }\nc { .inherit }":       `requires an object name`,
+	}
+	for s, msg := range errors {
+		_, err := NewParser(strings.NewReader(s)).Ucl()
+		if err == nil || !strings.Contains(err.Error(), msg) {
+			t.Errorf("%s: got error %v, want %q", s, err, msg)
+		}
+	}
+}
+
+func TestRegisterMacro(t *testing.T) {
+	secrets := map[string] string{"vault/db": "s3cret"}
+	var labels Node
+	handlers := map[string] MacroFunc{
+		"secret": func(ctx MacroContext, args Object, body Node) error {
+			v, ok := secrets[body.(string)]
+			if !ok {
+				return fmt.Errorf("no secret %v", body)
+			}
+			return ctx.Set(args["key"].(string), v)
+		},
+		"snippet": func(ctx MacroContext, args Object, body Node) error {
+			return ctx.Parse([]byte("pool = 10;\nidle = 2;\n"))
+		},
+		"upper": func(ctx MacroContext, args Object, body Node) error {
+			data, err := ctx.ReadFile(body.(string))
+			if err != nil {
+				return err
+			}
+			return ctx.Set(args["key"].(string),
+			               strings.ToUpper(string(data)))
+		},
+		"labels": func(ctx MacroContext, args Object, body Node) error {
+			if ctx.Name() != "labels" || ctx.Origin().Line != 7 {
+				return fmt.Errorf("bad context %s %v", ctx.Name(),
+				                  ctx.Origin())
+			}
+			labels = body
+			return nil
+		},
+	}
+	parse := func(s string, reject bool) (*Parser, map[string] interface{}, error) {
+		p := NewParser(strings.NewReader(s))
+		p.SetFS(fstest.MapFS{"motd.txt": {Data: []byte("hello")}}, ".")
+		for name, fn := range handlers {
+			p.RegisterMacro(name, fn)
+		}
+		if reject {
+			p.RegisterMacro("include", func(ctx MacroContext, args Object,
+			                                body Node) error {
+				return fmt.Errorf("not allowed")
+			})
+		}
+		ucl, err := p.Ucl()
+		return p, ucl, err
+	}
+
+	s := `
+db {
+	.secret(key=password) "vault/db"
+	.snippet "pool"
+	.upper(key=motd) "motd.txt"
+}
+.labels { env = prod; }
+.unregistered = kept;
+`
+	p, ucl, err := parse(s, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := ucl["db"].(map[string] interface{})
+	if db["password"] != "s3cret" || db["pool"] != "10" ||
+	   db["idle"] != "2" || db["motd"] != "HELLO" {
+		t.Errorf("db: got %v", db)
+	}
+	if l, _ := labels.(map[string] interface{}); l == nil || l["env"] != "prod" {
+		t.Errorf("labels body: got %v", labels)
+	}
+	if ucl[".unregistered"] != "kept" {
+		t.Errorf("unregistered: got %v", ucl[".unregistered"])
+	}
+	if o, _ := p.Origin("db.password"); o.Line != 3 {
+		t.Errorf("origin of password: got %v", o)
+	}
+	if o, _ := p.Origin("db.pool"); o.File != ".snippet" ||
+	   len(o.Chain) != 1 || o.Chain[0] != "<input>:4" {
+		t.Errorf("origin of pool: got %v", o)
+	}
+
+	errors := map[string] string{
+		`.secret(key=x) "vault/nope"`: `.secret: no secret vault/nope at line 1`,
+		`.include "motd.txt"`:         `.include: not allowed at line 1`,
+	}
+	for s, msg := range errors {
+		if _, _, err = parse(s + "\n", true); err == nil || err.Error() != msg {
+			t.Errorf("%s: got error %v, want %q", s, err, msg)
+		}
+	}
+}
@@ -0,0 +1,288 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A key that was renamed, or otherwise deprecated, found by Migrate
+type Deprecation struct {
+	Path    string  // e.g. "server[1].listn"
+	Message string  // e.g. "is deprecated, use server[1].listen"
+	Origin  *Origin // where the key was set, when known
+}
+
+func (d *Deprecation) Error() string {
+	return d.Path + " " + d.Message + d.Origin.at()
+}
+
+// Upgrades the parsed document from the version before m.Version to it
+type MigrationFunc func(m *Migration) error
+
+// The document being migrated by a MigrationFunc
+type Migration struct {
+	Version int
+
+	p        *Parser
+	warnings []*Deprecation
+}
+
+type alias struct {
+	old, new string
+}
+
+// The parsed document, to be changed in place
+func (m *Migration) Object() map[string] interface{} {
+	return m.p.ucl
+}
+
+// Move the value at old to new, as Parser.Alias does, with a deprecation
+// warning for each one moved
+func (m *Migration) Rename(old, new string) error {
+	return m.p.rename(old, new, &m.warnings)
+}
+
+// Warn that the key at path is deprecated, if it is set
+func (m *Migration) Warn(path, message string) {
+	if _, _, _, _, ok := m.p.findPath(path); !ok {
+		return
+	}
+	m.warnings = append(m.warnings, m.p.deprecation(path, message))
+}
+
+// Declare that the key at path old, e.g. "server.listn", is now at new,
+// e.g. "server.listen", for Migrate. Lists of objects on the way are
+// renamed within each object, and a value already at new is kept.
+func (p *Parser) Alias(old, new string) {
+	p.aliases = append(p.aliases, alias{old, new})
+}
+
+// Add a migration that upgrades documents to version, for Migrate
+func (p *Parser) AddMigration(version int, fn MigrationFunc) {
+	if p.migrations == nil {
+		p.migrations = make(map[int] MigrationFunc)
+	}
+	p.migrations[version] = fn
+}
+
+// Upgrade the parsed document before it is decoded. Migrations above the
+// document's version, the integer at versionKey (0 if it is not set), run
+// in order, and the document is given the last one's version. Aliases are
+// then applied. The keys renamed or warned about are returned, with where
+// they were set.
+func (p *Parser) Migrate(versionKey string) ([]*Deprecation, error) {
+	version := 0
+	if v, ok := p.ucl[versionKey]; ok {
+		n, err := strconv.Atoi(fmt.Sprint(v))
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid version %v", versionKey, v)
+		}
+		version = n
+	}
+
+	var versions []int
+	for n := range p.migrations {
+		if n > version {
+			versions = append(versions, n)
+		}
+	}
+	sort.Ints(versions)
+
+	m := &Migration{p: p}
+	for _, n := range versions {
+		m.Version = n
+		if err := p.migrations[n](m); err != nil {
+			return nil, fmt.Errorf("migrating to version %d: %v", n, err)
+		}
+	}
+	if len(versions) > 0 {
+		v, err := p.leafvalue(&tag{val: []byte(strconv.Itoa(m.Version)),
+		                          state: TAG})
+		if err != nil {
+			return nil, err
+		}
+		setKey(p.ucl, versionKey, v)
+	}
+
+	for _, a := range p.aliases {
+		if err := p.rename(a.old, a.new, &m.warnings); err != nil {
+			return nil, err
+		}
+	}
+	return m.warnings, nil
+}
+
+func (p *Parser) deprecation(path, message string) *Deprecation {
+	d := &Deprecation{Path: path, Message: message}
+	if o, ok := p.Origin(path); ok {
+		d.Origin = &o
+	}
+	return d
+}
+
+// Move the values at old to new, within each object of any lists on their
+// common path, adding a warning for each to warnings
+func (p *Parser) rename(old, new string, warnings *[]*Deprecation) error {
+	olds, news := strings.Split(old, "."), strings.Split(new, ".")
+	n := 0
+	for n < len(olds) - 1 && n < len(news) - 1 && olds[n] == news[n] {
+		n++
+	}
+	return p.renameIn(p.ucl, "", olds[:n], olds[n:], news[n:], warnings)
+}
+
+func (p *Parser) renameIn(m map[string] interface{}, path string,
+                          common, old, new []string,
+                          warnings *[]*Deprecation) error {
+	if len(common) > 0 {
+		k, ok := lookupKey(m, common[0])
+		if !ok {
+			return nil
+		}
+		path = joinPath(path, k)
+		switch v := m[k].(type) {
+		case map[string] interface{}:
+			return p.renameIn(v, path, common[1:], old, new, warnings)
+		case []interface{}:
+			for i := range v {
+				if cm, ok := v[i].(map[string] interface{}); ok {
+					err := p.renameIn(cm, fmt.Sprintf("%s[%d]", path, i),
+					                  common[1:], old, new, warnings)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	}
+
+	// find the old key
+	om, opath := m, path
+	var k string
+	for i, name := range old {
+		var ok bool
+		if k, ok = lookupKey(om, name); !ok {
+			return nil
+		}
+		opath = joinPath(opath, k)
+		if i < len(old) - 1 {
+			if om, ok = om[k].(map[string] interface{}); !ok {
+				return nil
+			}
+		}
+	}
+	npath := path
+	for _, name := range new {
+		npath = joinPath(npath, name)
+	}
+
+	// check the objects on the new path before moving anything; the old
+	// key is taken as gone, as it will be
+	nm, cpath := m, path
+	for _, name := range new[:len(new)-1] {
+		nk, ok := lookupKey(nm, name)
+		if !ok || (nk == k && sameMap(nm, om)) {
+			break
+		}
+		cpath = joinPath(cpath, nk)
+		if nm, ok = nm[nk].(map[string] interface{}); !ok {
+			return fmt.Errorf("%s: cannot rename to %s, as %s is not an object",
+			                  opath, npath, cpath)
+		}
+	}
+	*warnings = append(*warnings,
+	                   p.deprecation(opath, "is deprecated, use " + npath))
+
+	// and move it, unless the new one is set
+	v, okey := om[k], mapOriginKey(om, k)
+	deleteKey(om, k)
+	defer delete(p.origins, okey)
+	nm = m
+	for i, name := range new {
+		nk, ok := lookupKey(nm, name)
+		if i == len(new) - 1 {
+			if ok {
+				p.forget(v)
+			} else {
+				setKey(nm, name, v)
+				p.setMapOrigins(nm, name, p.copyOrigins(okey))
+			}
+			return nil
+		}
+		if !ok {
+			cm := make(map[string] interface{})
+			if UclExportKeyOrder {
+				cm[KeyOrder] = []string{}
+			}
+			setKey(nm, name, cm)
+			p.setMapOrigins(nm, name, p.copyOrigins(okey))
+			nm = cm
+			continue
+		}
+		nm = nm[nk].(map[string] interface{})
+	}
+	return nil
+}
+
+// Whether a and b are the same map
+func sameMap(a, b map[string] interface{}) bool {
+	return reflect.ValueOf(a).Pointer() == reflect.ValueOf(b).Pointer()
+}
+
+// Set m[k] to v, keeping the order of m's keys
+func setKey(m map[string] interface{}, k string, v interface{}) {
+	if _, ok := m[k]; !ok {
+		if korder, ok := m[KeyOrder].([]string); ok {
+			m[KeyOrder] = append(korder, k)
+		}
+	}
+	m[k] = v
+}
+
+// Remove k from m, and from the order of its keys
+func deleteKey(m map[string] interface{}, k string) {
+	delete(m, k)
+	korder, ok := m[KeyOrder].([]string)
+	if !ok {
+		return
+	}
+	nkorder := make([]string, 0, len(korder))
+	for _, ck := range korder {
+		if ck != k {
+			nkorder = append(nkorder, ck)
+		}
+	}
+	m[KeyOrder] = nkorder
+}
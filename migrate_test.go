@@ -0,0 +1,165 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	s := `
+version = 1;
+servers {
+	listn = 80;
+}
+servers {
+	listn = 81;
+	listen = 82;
+}
+log = debug;
+`
+	p := NewParserFlags(strings.NewReader(s), ParseNumbers)
+	ucl, err := p.Ucl()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ran []int
+	p.AddMigration(1, func(m *Migration) error {
+		return fmt.Errorf("already at version 1")
+	})
+	p.AddMigration(3, func(m *Migration) error {
+		ran = append(ran, m.Version)
+		m.Warn("nothing", "is gone")
+		return m.Rename("log", "logging.level")
+	})
+	p.AddMigration(2, func(m *Migration) error {
+		ran = append(ran, m.Version)
+		m.Object()["added"] = "x"
+		return nil
+	})
+	p.Alias("servers.listn", "servers.listen")
+
+	warnings, err := p.Migrate("version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msgs []string
+	for _, w := range warnings {
+		msgs = append(msgs, w.Error())
+	}
+	expect := []string{
+		"log is deprecated, use logging.level at line 10",
+		"servers[0].listn is deprecated, use servers[0].listen at line 4",
+		"servers[1].listn is deprecated, use servers[1].listen at line 7",
+	}
+	if !reflect.DeepEqual(msgs, expect) {
+		t.Errorf("got warnings %q", msgs)
+	}
+	if !reflect.DeepEqual(ran, []int{2, 3}) {
+		t.Errorf("ran migrations %v", ran)
+	}
+
+	type server struct {
+		Listen int `ucl:"listen"`
+	}
+	var cfg struct {
+		Version int      `ucl:"version"`
+		Servers []server `ucl:"servers"`
+		Logging struct {
+			Level string `ucl:"level"`
+		} `ucl:"logging"`
+		Added string `ucl:"added"`
+	}
+	if err = Decode(ucl, &cfg, "ucl"); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Version != 3 || cfg.Logging.Level != "debug" || cfg.Added != "x" ||
+	   !reflect.DeepEqual(cfg.Servers, []server{{80}, {82}}) {
+		t.Errorf("got %+v", cfg)
+	}
+	if o, ok := p.Origin("logging.level"); !ok || o.Line != 10 {
+		t.Errorf("logging.level origin: got %v", o)
+	}
+	if keys := ucl[KeyOrder].([]string); keys[len(keys)-1] != "logging" {
+		t.Errorf("key order: got %v", keys)
+	}
+
+	errors := map[string] string{
+		"version = x;":  "version: invalid version x",
+		"a = 1;":        "migrating to version 1: failed",
+		"b = 1; a = 1;": "migrating to version 1: b: cannot rename to a.c, " +
+		                 "as a is not an object",
+	}
+	for in, expect := range errors {
+		p := NewParser(strings.NewReader(in))
+		if _, err := p.Ucl(); err != nil {
+			t.Fatal(err)
+		}
+		p.AddMigration(1, func(m *Migration) error {
+			if _, ok := m.Object()["b"]; ok {
+				return m.Rename("b", "a.c")
+			}
+			return fmt.Errorf("failed")
+		})
+		if _, err := p.Migrate("version"); err == nil || err.Error() != expect {
+			t.Errorf("%s: unexpected error: %v", in, err)
+		}
+	}
+
+	// a failed rename leaves the old key be
+	p = NewParser(strings.NewReader("b = 1; a = 1;"))
+	if _, err := p.Ucl(); err != nil {
+		t.Fatal(err)
+	}
+	p.Alias("b", "a.c")
+	if _, err := p.Migrate("version"); err == nil || p.ucl["b"] != "1" {
+		t.Errorf("failed rename: got %v, %v", p.ucl, err)
+	}
+
+	// a key may become an object holding its value
+	p = NewParser(strings.NewReader("log = debug;\n"))
+	if _, err := p.Ucl(); err != nil {
+		t.Fatal(err)
+	}
+	p.Alias("log", "log.level")
+	warnings, err = p.Migrate("version")
+	if err != nil || len(warnings) != 1 {
+		t.Fatalf("got %v, %v", warnings, err)
+	}
+	if l, _ := p.ucl["log"].(map[string] interface{}); l["level"] != "debug" {
+		t.Errorf("log: got %v", p.ucl["log"])
+	}
+	if o, ok := p.Origin("log.level"); !ok || o.Line != 1 {
+		t.Errorf("log.level origin: got %v", o)
+	}
+}
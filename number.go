@@ -0,0 +1,293 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// A Number is a numeric literal exactly as written in the UCL source. It is
+// returned in place of int64, uint64 and float64 values when parsing with
+// ParseUseNumber, like json.Number.
+type Number string
+
+// Returns the literal text of the number.
+func (n Number) String() string {
+	return string(n)
+}
+
+func numError(fn string, n Number, err error) error {
+	return &strconv.NumError{Func: fn, Num: string(n), Err: err}
+}
+
+// Returns the number as a float64.
+func (n Number) Float64() (float64, error) {
+	v, ok, _ := parseNumber(string(n), true)
+	if !ok {
+		return 0, numError("ParseFloat", n, strconv.ErrSyntax)
+	}
+	switch x := v.(type) {
+	case int64:
+		return float64(x), nil
+	case uint64:
+		return float64(x), nil
+	}
+	return v.(float64), nil
+}
+
+// Returns the number as an int64.
+func (n Number) Int64() (int64, error) {
+	v, ok, _ := parseNumber(string(n), true)
+	if !ok {
+		return 0, numError("ParseInt", n, strconv.ErrSyntax)
+	}
+	switch x := v.(type) {
+	case int64:
+		return x, nil
+	case uint64:
+		return 0, numError("ParseInt", n, strconv.ErrRange)
+	}
+	return 0, numError("ParseInt", n, strconv.ErrSyntax)
+}
+
+// Returns the number as a uint64.
+func (n Number) Uint64() (uint64, error) {
+	v, ok, _ := parseNumber(string(n), true)
+	if !ok {
+		return 0, numError("ParseUint", n, strconv.ErrSyntax)
+	}
+	switch x := v.(type) {
+	case int64:
+		if x < 0 {
+			return 0, numError("ParseUint", n, strconv.ErrRange)
+		}
+		return uint64(x), nil
+	case uint64:
+		return x, nil
+	}
+	return 0, numError("ParseUint", n, strconv.ErrSyntax)
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// Skip over the digits at the start of s, returning how many there are
+func digits(s string) int {
+	i := 0
+	for i < len(s) && isDigit(s[i]) {
+		i++
+	}
+	return i
+}
+
+// Whether s is a decimal number: [+-]digits[.digits][e[+-]digits], and
+// whether it is an integer
+func isNumber(s string) (isnum, isint bool) {
+	i := 0
+	if i < len(s) && (s[i] == '+' || s[i] == '-') {
+		i++
+	}
+	n := digits(s[i:])
+	if n == 0 {
+		return false, false
+	}
+	i += n
+	isint = true
+	if i < len(s) && s[i] == '.' {
+		i++
+		if n = digits(s[i:]); n == 0 {
+			return false, false
+		}
+		i += n
+		isint = false
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		i++
+		if i < len(s) && (s[i] == '+' || s[i] == '-') {
+			i++
+		}
+		if n = digits(s[i:]); n == 0 {
+			return false, false
+		}
+		i += n
+		isint = false
+	}
+	return i == len(s), isint
+}
+
+// Whether s is one of the non-finite literals nan, inf, +inf or -inf
+func isNonFinite(s string) bool {
+	switch strings.ToLower(s) {
+	case "nan", "inf", "+inf", "-inf":
+		return true
+	}
+	return false
+}
+
+// Whether c is a digit in the given base
+func isBaseDigit(c byte, base int) bool {
+	switch base {
+	case 2:
+		return c == '0' || c == '1'
+	case 8:
+		return c >= '0' && c <= '7'
+	case 16:
+		return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+	}
+	return isDigit(c)
+}
+
+// Check the '_' digit separators in s, which must each sit between two
+// digits, or, if prefixed, between the base prefix (ending at s[start-1])
+// and a digit. Returns the offset of the first misplaced one, or -1.
+func checkUnderscores(s string, start, base int, prefixed bool) int {
+	for i := start; i < len(s); i++ {
+		if s[i] != '_' {
+			continue
+		}
+		if (i == start && !prefixed) ||
+		   (i > start && !isBaseDigit(s[i-1], base)) ||
+		   i+1 >= len(s) || !isBaseDigit(s[i+1], base) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Convert the literal s to an int64, a uint64 if it is too large for an
+// int64, or otherwise a float64. ok is false if s is not a number.
+//
+// Besides decimal numbers, 0x hex integers are accepted as in libucl, and
+// when goforms is set so are Go's 0o octal and 0b binary integers and '_'
+// digit separators. If s looks like one of these but is malformed, bad is
+// the offset of the offending character; otherwise it is -1.
+func parseNumber(s string, goforms bool) (n interface{}, ok bool, bad int) {
+	if isNonFinite(s) {
+		f, _ := strconv.ParseFloat(s, 64)
+		return f, true, -1
+	}
+
+	i := 0
+	neg := false
+	if i < len(s) && (s[i] == '+' || s[i] == '-') {
+		neg = s[i] == '-'
+		i++
+	}
+
+	// integer with base prefix
+	base := 0
+	if len(s) >= i+2 && s[i] == '0' {
+		switch s[i+1] {
+		case 'x', 'X':
+			base = 16
+		case 'o', 'O':
+			if goforms {
+				base = 8
+			}
+		case 'b', 'B':
+			if goforms {
+				base = 2
+			}
+		}
+	}
+	if base != 0 {
+		start := i + 2
+		if start == len(s) {
+			return nil, false, start
+		}
+		for j := start; j < len(s); j++ {
+			if !isBaseDigit(s[j], base) && !(goforms && s[j] == '_') {
+				return nil, false, j
+			}
+		}
+		if j := checkUnderscores(s, start, base, true); j >= 0 {
+			return nil, false, j
+		}
+		u, err := strconv.ParseUint(strings.Replace(s[start:], "_", "", -1),
+		                            base, 64)
+		if err != nil {
+			// too large; leave it as a string
+			return nil, false, -1
+		}
+		switch {
+		case neg && u <= 1 << 63:
+			return -int64(u - 1) - 1, true, -1
+		case neg:
+			return nil, false, -1
+		case u <= math.MaxInt64:
+			return int64(u), true, -1
+		}
+		return u, true, -1
+	}
+
+	// decimal
+	digits := s
+	if goforms && strings.Contains(s, "_") {
+		digits = strings.Replace(s, "_", "", -1)
+	}
+	isnum, isint := isNumber(digits)
+	if !isnum {
+		return nil, false, -1
+	}
+	if len(digits) != len(s) {
+		if j := checkUnderscores(s, i, 10, false); j >= 0 {
+			return nil, false, j
+		}
+	}
+	if isint {
+		if i, err := strconv.ParseInt(digits, 10, 64); err == nil {
+			return i, true, -1
+		}
+		if u, err := strconv.ParseUint(digits, 10, 64); err == nil {
+			return u, true, -1
+		}
+	}
+	f, err := strconv.ParseFloat(digits, 64)
+	if err != nil {
+		// out of range
+		return nil, false, -1
+	}
+	return f, true, -1
+}
+
+// Format f in the shortest form that parses back to the same value, using
+// an exponent only for very large or small magnitudes (as encoding/json)
+func formatFloat(f float64, bits int) string {
+	fmtc := byte('f')
+	if abs := math.Abs(f); abs != 0 {
+		if bits == 64 && (abs < 1e-6 || abs >= 1e21) ||
+		   bits == 32 && (float32(abs) < 1e-6 || float32(abs) >= 1e21) {
+			fmtc = 'e'
+		}
+	}
+	return strconv.FormatFloat(f, fmtc, -1, bits)
+}
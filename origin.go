@@ -0,0 +1,270 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Where a value in the parsed result was set
+type Origin struct {
+	File     string   // "" for the parser's own input
+	Line     int
+	Col      int
+	Chain    []string // "file:line" of each .include leading to File,
+	                  // outermost first
+	Priority int      // of the .include that read File
+
+	// The value was replaced by one of a higher priority, or was ignored
+	// as an earlier value had a higher priority
+	Overridden bool
+}
+
+func (o Origin) String() string {
+	file := o.File
+	if file == "" {
+		file = "<input>"
+	}
+	s := fmt.Sprintf("%s:%d:%d", file, o.Line, o.Col)
+	if len(o.Chain) > 0 {
+		s += " (included from " + strings.Join(o.Chain, ", ") + ")"
+	}
+	if o.Priority != 0 {
+		s += fmt.Sprintf(" priority %d", o.Priority)
+	}
+	if o.Overridden {
+		s += " overridden"
+	}
+	return s
+}
+
+// Where o is, for messages, e.g. " in a.conf at line 3", or "" if o is nil
+func (o *Origin) at() string {
+	switch {
+	case o == nil:
+		return ""
+	case o.File != "":
+		return fmt.Sprintf(" in %s at line %d", o.File, o.Line)
+	}
+	return fmt.Sprintf(" at line %d", o.Line)
+}
+
+// A key of a map, or an element (key == "") of a list, in the result
+type originKey struct {
+	container uintptr
+	key       string
+	index     int
+}
+
+// What is known of a key: the origins of its values, and whether its value
+// was inherited, for a local one to replace. The record holds on to the
+// map, or to the list's first element, so that its address is not reused
+// by another while the record is kept.
+type originRecord struct {
+	origins   []*Origin
+	inherited bool
+	container interface{}
+}
+
+func mapOriginKey(m map[string] interface{}, k string) originKey {
+	return originKey{reflect.ValueOf(m).Pointer(), k, -1}
+}
+
+func listOriginKey(l []interface{}, i int) originKey {
+	return originKey{reflect.ValueOf(l).Pointer(), "", i}
+}
+
+// The origin of a value read at t
+func (p *Parser) origin(t *tag) *Origin {
+	return &Origin{
+		File: p.name,
+		Line: t.line,
+		Col: t.col,
+		Chain: p.chain,
+		Priority: p.priority,
+	}
+}
+
+// Set the origins, if any, of key k of map m
+func (p *Parser) setMapOrigins(m map[string] interface{}, k string,
+                               ol []*Origin) {
+	if len(ol) > 0 {
+		key := mapOriginKey(m, k)
+		r := p.origins[key]
+		r.origins, r.container = ol, m
+		p.origins[key] = r
+	}
+}
+
+// Set the origins, if any, of element i of list l
+func (p *Parser) setListOrigins(l []interface{}, i int, ol []*Origin) {
+	if len(ol) > 0 {
+		key := listOriginKey(l, i)
+		r := p.origins[key]
+		r.origins, r.container = ol, &l[0]
+		p.origins[key] = r
+	}
+}
+
+// Record the origins of the elements of a list, which must be complete as
+// elements are known by the list's address
+func (p *Parser) recordList(l []interface{}, elems []*Origin) {
+	for i := range elems {
+		p.setListOrigins(l, i, elems[i:i+1])
+	}
+}
+
+// Update the origins of the elements of list l, as it becomes nl with v,
+// from o, appended
+func (p *Parser) appendOrigin(l, nl []interface{}, o *Origin) {
+	if len(l) > 0 && reflect.ValueOf(l).Pointer() != reflect.ValueOf(nl).Pointer() {
+		for i := range l {
+			if r, ok := p.origins[listOriginKey(l, i)]; ok {
+				p.setListOrigins(nl, i, r.origins)
+				delete(p.origins, listOriginKey(l, i))
+			}
+		}
+	}
+	p.setListOrigins(nl, len(nl) - 1, []*Origin{o})
+}
+
+// A copy of the origins of key, if any
+func (p *Parser) copyOrigins(key originKey) []*Origin {
+	ol := p.origins[key].origins
+	if ol == nil {
+		return nil
+	}
+	nl := make([]*Origin, len(ol))
+	for i := range ol {
+		o := *ol[i]
+		nl[i] = &o
+	}
+	return nl
+}
+
+// Drop the records of the keys and elements within v, as it is replaced
+func (p *Parser) forget(v interface{}) {
+	switch v := v.(type) {
+	case map[string] interface{}:
+		for k, cv := range v {
+			p.forget(cv)
+			delete(p.origins, mapOriginKey(v, k))
+		}
+	case []interface{}:
+		for i := range v {
+			p.forget(v[i])
+			delete(p.origins, listOriginKey(v, i))
+		}
+	}
+}
+
+// Find the value at a path, as in Decode errors, e.g. "server[1].port",
+// and the map (with its key) or list (with index >= 0) holding it. As Decode
+// takes a key given once as a list of one, [0] of any other value is that
+// value.
+func (p *Parser) findPath(path string) (parent interface{}, key string,
+                                         index int, v interface{}, ok bool) {
+	v = p.ucl
+	for _, part := range strings.Split(path, ".") {
+		name := part
+		if i := strings.IndexByte(part, '['); i >= 0 {
+			name = part[:i]
+		}
+		if name != "" {
+			m, ok := v.(map[string] interface{})
+			if !ok || name == KeyOrder {
+				return nil, "", 0, nil, false
+			}
+			if v, ok = m[name]; !ok {
+				return nil, "", 0, nil, false
+			}
+			parent, key, index = m, name, -1
+		}
+
+		for rest := part[len(name):]; rest != ""; {
+			end := strings.IndexByte(rest, ']')
+			if rest[0] != '[' || end < 0 {
+				return nil, "", 0, nil, false
+			}
+			i, err := strconv.Atoi(rest[1:end])
+			l, ok := v.([]interface{})
+			if !ok && err == nil && i == 0 {
+				rest = rest[end+1:]
+				continue
+			}
+			if err != nil || !ok || i < 0 || i >= len(l) {
+				return nil, "", 0, nil, false
+			}
+			parent, key, index = l, "", i
+			v = l[i]
+			rest = rest[end+1:]
+		}
+	}
+	return parent, key, index, v, parent != nil
+}
+
+// Find the record for a path
+func (p *Parser) originKey(path string) (originKey, bool) {
+	parent, key, index, _, ok := p.findPath(path)
+	if !ok {
+		return originKey{}, false
+	}
+	if m, ok := parent.(map[string] interface{}); ok {
+		return mapOriginKey(m, key), true
+	}
+	return listOriginKey(parent.([]interface{}), index), true
+}
+
+// List every value that was given for a path, e.g. "server[1].port", in
+// the order they were parsed, including those that were overridden
+func (p *Parser) Explain(path string) []Origin {
+	key, ok := p.originKey(path)
+	if !ok {
+		return nil
+	}
+	var res []Origin
+	for _, o := range p.origins[key].origins {
+		res = append(res, *o)
+	}
+	return res
+}
+
+// Where the value at a path, e.g. "server[1].port", was set
+func (p *Parser) Origin(path string) (Origin, bool) {
+	list := p.Explain(path)
+	for i := len(list) - 1; i >= 0; i-- {
+		if !list[i].Overridden {
+			return list[i], true
+		}
+	}
+	return Origin{}, false
+}
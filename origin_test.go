@@ -0,0 +1,156 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+func TestOrigins(t *testing.T) {
+	fsys := fstest.MapFS{
+		"etc/main.conf": {Data: []byte(`name = main;
+server {
+  port = 80;
+}
+.include(priority=1) "override.conf"
+.include "extra.conf"
+list [ a,
+       b ]
+dup = 1;
+dup = 2;
+`)},
+		"etc/override.conf": {Data: []byte("name = override;\n")},
+		"etc/extra.conf": {Data: []byte(".include \"deep.conf\"\nname = extra;\n")},
+		"etc/deep.conf": {Data: []byte("deep = yes;\n")},
+	}
+
+	p, err := NewFSParser(fsys, "etc/main.conf", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ucl, err := p.Ucl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ucl["name"] != "override" {
+		t.Errorf("name: got %v", ucl["name"])
+	}
+
+	main := []string{"etc/main.conf:6"}
+	expect := []Origin{
+		{File: "etc/main.conf", Line: 1, Col: 1, Overridden: true},
+		{File: "etc/override.conf", Line: 1, Col: 1,
+		 Chain: []string{"etc/main.conf:5"}, Priority: 1},
+		{File: "etc/extra.conf", Line: 2, Col: 1, Chain: main,
+		 Overridden: true},
+	}
+	if got := p.Explain("name"); !reflect.DeepEqual(got, expect) {
+		t.Errorf("Explain(name): got %v, want %v", got, expect)
+	}
+
+	origins := map[string] Origin{
+		"server.port": {File: "etc/main.conf", Line: 3, Col: 3},
+		"list[1]": {File: "etc/main.conf", Line: 8, Col: 8},
+		"dup[0]": {File: "etc/main.conf", Line: 9, Col: 1},
+		"dup[1]": {File: "etc/main.conf", Line: 10, Col: 1},
+		"deep": {File: "etc/deep.conf", Line: 1, Col: 1,
+		         Chain: []string{"etc/main.conf:6", "etc/extra.conf:1"}},
+	}
+	for path, want := range origins {
+		if got, ok := p.Origin(path); !ok || !reflect.DeepEqual(got, want) {
+			t.Errorf("Origin(%s): got %v, want %v", path, got, want)
+		}
+	}
+	for _, path := range []string{"nope", "list[2]", "server.port.x", "dup[x]"} {
+		if got := p.Explain(path); got != nil {
+			t.Errorf("Explain(%s): got %v", path, got)
+		}
+	}
+
+	want := "etc/deep.conf:1:1 (included from etc/main.conf:6, etc/extra.conf:1)"
+	if o, _ := p.Origin("deep"); o.String() != want {
+		t.Errorf("String: got %q, want %q", o.String(), want)
+	}
+}
+
+// A replaced object must not pass its origins on to a new one allocated at
+// its address once it is collected
+func TestOriginsReplaced(t *testing.T) {
+	var main strings.Builder
+	main.WriteString(`.include(priority=5) "low.conf"
+.include(priority=10) "high.conf"
+.gc "now"
+`)
+	for i := 0; i < 200; i++ {
+		fmt.Fprintf(&main, "o%d { k = %d; }\n", i, i)
+	}
+	fsys := fstest.MapFS{
+		"main.conf": {Data: []byte(main.String())},
+		"low.conf": {Data: []byte("obj { k = low; list [ a, b ] }\n")},
+		"high.conf": {Data: []byte("obj { j = high }\n")},
+	}
+
+	p, err := NewFSParser(fsys, "main.conf", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.RegisterMacro("gc", func(ctx MacroContext, args Object, body Node) error {
+		runtime.GC()
+		return nil
+	})
+	ucl, err := p.Ucl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		path := fmt.Sprintf("o%d.k", i)
+		o, ok := p.Origin(path)
+		if m, _ := ucl[fmt.Sprintf("o%d", i)].(map[string] interface{});
+		   m["k"] != fmt.Sprint(i) || !ok || o.Priority != 0 {
+			t.Fatalf("%s: got %v, from %v", path, m, o)
+		}
+	}
+	if got := p.Explain("obj.k"); got != nil {
+		t.Errorf("Explain(obj.k): got %v", got)
+	}
+	if o, ok := p.Origin("obj.j"); !ok || o.File != "high.conf" {
+		t.Errorf("Origin(obj.j): got %v", o)
+	}
+	// and the replaced object's records are dropped
+	for key, r := range p.origins {
+		if key.key != "obj" && r.origins[0].File == "low.conf" {
+			t.Errorf("record kept for %v: %v", key, r.origins[0])
+		}
+	}
+}
@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Priorities of overlaid values, above those of any .include, with flags
+// taking precedence over the environment
+const (
+	EnvPriority  = 1 << 16
+	ArgsPriority = EnvPriority + 1
+)
+
+// Overlay environment variables, as from os.Environ(), onto the parsed
+// document. Those named prefix + key + sep + key ... set the value at that
+// path, e.g. APP_SECTION_FOO=bar with prefix "APP_" and sep "_" sets
+// section.foo. Keys match existing ones regardless of case, including
+// those that contain sep, and are otherwise created in lower case.
+func (p *Parser) OverlayEnv(environ []string, prefix, sep string) error {
+	for _, kv := range environ {
+		i := strings.IndexByte(kv, '=')
+		if i < 0 || !strings.HasPrefix(kv[:i], prefix) {
+			continue
+		}
+		name, value := kv[:i], kv[i+1:]
+		segs := strings.Split(name[len(prefix):], sep)
+		o := &Origin{File: "$" + name, Priority: EnvPriority}
+		if err := p.overlay(segs, sep, true, value, o); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Overlay command line flags of the form --prefix.path.to.key=value onto
+// the parsed document, returning the other arguments. Flags after "--" are
+// not overlaid.
+func (p *Parser) OverlayArgs(args []string, prefix string) ([]string, error) {
+	var rest []string
+	for i, arg := range args {
+		if arg == "--" {
+			return append(rest, args[i:]...), nil
+		}
+		eq := strings.IndexByte(arg, '=')
+		if !strings.HasPrefix(arg, "--" + prefix) || eq < 0 {
+			rest = append(rest, arg)
+			continue
+		}
+		path := arg[len(prefix)+2:eq]
+		o := &Origin{File: "--" + prefix + path, Priority: ArgsPriority}
+		err := p.overlay(strings.Split(path, "."), ".", false, arg[eq+1:], o)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rest, nil
+}
+
+// Set the value at the path given by segs, typed as the parser would type
+// it, creating objects along the way. A key may match several segments
+// joined by sep; new keys are lowered if lower is set.
+func (p *Parser) overlay(segs []string, sep string, lower bool,
+                         value string, o *Origin) error {
+	for _, s := range segs {
+		if s == "" {
+			return fmt.Errorf("%s: invalid path", o.File)
+		}
+	}
+
+	v, err := p.leafvalue(&tag{val: []byte(value), state: TAG})
+	if err != nil {
+		return fmt.Errorf("%s: invalid value %q", o.File, value)
+	}
+
+	m := p.ucl
+	for len(segs) > 0 {
+		key, n := matchKey(m, segs, sep)
+		if n == 0 {
+			key, n = segs[0], 1
+			if lower {
+				key = strings.ToLower(key)
+			}
+		}
+		segs = segs[n:]
+
+		if len(segs) == 0 {
+			return p.addValue(m, key, v, o)
+		}
+		switch cv := m[key].(type) {
+		case map[string] interface{}:
+			m = cv
+		case nil:
+			if _, ok := m[key]; ok {
+				return fmt.Errorf("%s: %s is not an object", o.File, key)
+			}
+			nm := make(map[string] interface{})
+			if err := p.addValue(m, key, nm, o); err != nil {
+				return err
+			}
+			m = nm
+		default:
+			return fmt.Errorf("%s: %s is not an object", o.File, key)
+		}
+	}
+	return nil
+}
+
+// Find the key of m matching the most of segs joined by sep, preferring an
+// exact match to one ignoring case, and return how many segs it took
+func matchKey(m map[string] interface{}, segs []string,
+              sep string) (string, int) {
+	for n := len(segs); n > 0; n-- {
+		name := strings.Join(segs[:n], sep)
+		if _, ok := m[name]; ok && name != KeyOrder {
+			return name, n
+		}
+		for k := range m {
+			if k != KeyOrder && strings.EqualFold(k, name) {
+				return k, n
+			}
+		}
+	}
+	return "", 0
+}
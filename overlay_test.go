@@ -0,0 +1,98 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestOverlay(t *testing.T) {
+	s := `
+section {
+	foo = 1;
+	max_conns = 10;
+}
+name = app;
+`
+	p := NewParserFlags(strings.NewReader(s), ParseNumbers)
+	ucl, err := p.Ucl()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.OverlayEnv([]string{
+		"HOME=/root",
+		"APP_SECTION_FOO=bar",
+		"APP_SECTION_MAX_CONNS=20",
+		"APP_NEW_KEY=0x10",
+		"APP_NAME=env",
+	}, "APP_", "_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rest, err := p.OverlayArgs([]string{"-v", "--name=flag", "--section.foo=2.5",
+	                                    "--verbose", "--", "--name=x"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rest, []string{"-v", "--verbose", "--", "--name=x"}) {
+		t.Errorf("rest: got %v", rest)
+	}
+
+	section := ucl["section"].(map[string] interface{})
+	if section["foo"] != 2.5 || section["max_conns"] != int64(20) ||
+	   ucl["name"] != "flag" || ucl["home"] != nil {
+		t.Errorf("got %v", ucl)
+	}
+	if n, _ := ucl["new"].(map[string] interface{}); n == nil ||
+	   n["key"] != int64(16) {
+		t.Errorf("new.key: got %v", ucl["new"])
+	}
+
+	e := p.Explain("name")
+	if len(e) != 3 || !e[0].Overridden || e[1].File != "$APP_NAME" ||
+	   !e[1].Overridden || e[2].File != "--name" ||
+	   e[2].Priority != ArgsPriority {
+		t.Errorf("explain name: got %v", e)
+	}
+
+	errors := map[string] string{
+		"APP_NAME_X=1":   "$APP_NAME_X: name is not an object",
+		"APP_SECTION_=1": "$APP_SECTION_: invalid path",
+		"APP_BAD=0x":     `$APP_BAD: invalid value "0x"`,
+	}
+	for env, msg := range errors {
+		err := p.OverlayEnv([]string{env}, "APP_", "_")
+		if err == nil || err.Error() != msg {
+			t.Errorf("%s: got error %v, want %q", env, err, msg)
+		}
+	}
+}
@@ -29,8 +29,14 @@
 package ucl
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"fmt"
 	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/url"
+	"path"
 )
 
 // The order of the keys as they appear in the file; this allows the user to
@@ -40,10 +46,35 @@ const KeyOrder = "--ucl-keyorder--"
 // Allow to disable constructing the KeyOrder arrays
 var UclExportKeyOrder bool = true
 
+// Flags for NewParserFlags
+const (
+	// Return unquoted numeric values as int64, uint64 (when too large for
+	// an int64) or float64 instead of as strings
+	ParseNumbers = 1 << iota
+
+	// Return unquoted numeric values as Number, which keeps the literal
+	// as written
+	ParseUseNumber
+
+	// Along with libucl's 0x hex numbers, accept Go's 0o octal and 0b
+	// binary forms and '_' digit separators in typed numeric values
+	ParseGoNumbers
+
+	// Return unquoted /regex/flags values as Regex instead of as strings.
+	// The regex must compile, and paths such as /tmp/ will also match.
+	ParseRegex
+
+	// Replace ${path.to.key} in string values with the value at that path
+	// in the document, once it is parsed. A value that is only a
+	// reference is replaced by a copy of the value, keeping its type, and
+	// "$${" gives a literal "${". Values set by .load are left as loaded.
+	ParseReferences
+)
+
 var Ucldebug bool = true
 func debug(a... interface{}) {
 	if Ucldebug {
-		fmt.Println(a)
+		fmt.Println(a...)
 	}
 }
 
@@ -56,19 +87,103 @@ type Parser struct {
 	tags    []*tag
 	tagsi   int
 
+	flags   int
+
+	// .include and .load read from fsys, relative to dir within it. When
+	// fsys is nil, it is opened on the OS directory root on first use,
+	// with dir being that of osfile.
+	fsys     fs.FS
+	dir      string
+	osfile   string
+	root     string
+	osroot   string     // root of an OS fsys, to check symlinks
+	keys     []ed25519.PublicKey
+	http     *HTTPOptions
+	base     *url.URL   // of a file read from a URL
+	depth    int        // .include nesting
+
+	// where values were set, shared with included files' parsers
+	origins  map[originKey]originRecord
+	name     string
+	chain    []string
+	priority int
+	macros   map[string] macroFunc    // from RegisterMacro
+
+	// renamed keys, and upgrades by version, for Migrate
+	aliases    []alias
+	migrations map[int] MigrationFunc
+
+	// the objects being parsed, outermost first, each followed by the
+	// keys that lead to the next, for .inherit
+	stack    []interface{}
+
 	done    bool
 	err     error
 }
 
 func NewParser(r io.Reader) *Parser {
+	return NewParserFlags(r, 0)
+}
+
+// Create a parser, with flags (ParseXXX) controlling how values are returned
+func NewParserFlags(r io.Reader, flags int) *Parser {
 	p := &Parser{
 		scanner: newScanner(r),
 		ucl: make(map[string] interface{}),
+		flags: flags,
+		origins: make(map[originKey]originRecord),
 	}
 
 	return p
 }
 
+// Create a parser for a file. Files it names with .include or .load are
+// relative to it, and must be within its directory unless SetRoot is used.
+func NewFileParser(filename string, flags int) (*Parser, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	p := NewParserFlags(bytes.NewReader(data), flags)
+	p.osfile = filename
+	p.name = filename
+	return p, nil
+}
+
+// Create a parser for file name within fsys. Files it names with .include
+// or .load are read from fsys relative to it, and may not be outside fsys.
+func NewFSParser(fsys fs.FS, name string, flags int) (*Parser, error) {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	p := NewParserFlags(bytes.NewReader(data), flags)
+	p.SetFS(fsys, path.Dir(name))
+	p.name = name
+	return p, nil
+}
+
+// Read the files named by .include and .load from fsys, relative to dir
+// within it, instead of from the OS filesystem
+func (p *Parser) SetFS(fsys fs.FS, dir string) {
+	p.fsys = fsys
+	p.dir = dir
+}
+
+// Restrict the files that .include and .load may read from the OS to those
+// within dir. This defaults to the directory of the file given to
+// NewFileParser; a parser of a reader reads no files until SetRoot or SetFS
+// is called.
+func (p *Parser) SetRoot(dir string) {
+	p.root = dir
+}
+
+// Set the keys that .include(sign=true) and .load(sign=true) accept
+// signatures from
+func (p *Parser) SetKeys(keys ...ed25519.PublicKey) {
+	p.keys = keys
+}
+
 func (p *Parser) nexttag() (*tag, error) {
 	var err error
 
@@ -98,6 +213,42 @@ func (p *Parser) nexttag() (*tag, error) {
 }
 
 
+// Convert a value tag into the value handed to the user. A closing brace or
+// bracket may carry the value that preceded it, with its state in flag.
+func (p *Parser) leafvalue(t *tag) (interface{}, error) {
+	state := t.state
+	if state == BRACECLOSE || state == BRACKETCLOSE {
+		state = t.flag
+	}
+
+	s := string(t.val)
+	if (state == TAG || state == SLASH) && p.flags & ParseRegex != 0 {
+		if source, flags, ok := splitRegex(s); ok {
+			r := Regex{source, flags}
+			if _, err := r.Compile(); err != nil {
+				return nil, fmt.Errorf("invalid regex %s at line %d column %d: %v",
+				                       s, t.line, t.col, err)
+			}
+			return r, nil
+		}
+	}
+	if state == TAG && p.flags & (ParseNumbers | ParseUseNumber) != 0 {
+		// only unquoted values are typed
+		n, ok, bad := parseNumber(s, p.flags & ParseGoNumbers != 0)
+		if bad >= 0 {
+			return nil, fmt.Errorf("malformed number %q at line %d column %d",
+			                       s, t.line, t.col + bad)
+		}
+		if ok {
+			if p.flags & ParseUseNumber != 0 {
+				return Number(s), nil
+			}
+			return n, nil
+		}
+	}
+	return s, nil
+}
+
 func (p *Parser) parsevalue(t *tag, parent interface{}) (interface{}, error) {
 	var err error
 
@@ -119,16 +270,22 @@ restart:
 		}
 
 		if nt == nil || nt.state == SEMICOL || nt.state == COMMA {
-			return string(t.val), nil;  // leaf value; done
+			return p.leafvalue(t)  // leaf value; done
 		}
 		if nt.state == BRACECLOSE || nt.state == BRACKETCLOSE {
+			// carry the value, and its type, back to the parent
 			nt.val = t.val
+			nt.flag = t.state
+			nt.line = t.line
+			nt.col = t.col
 			return nt, nil
 		}
 
 		// "t" is a new key tag
 		themap := make(map[string] interface{})
+		p.stack = append(p.stack, string(t.val))
 		res, err := p.parsevalue(nt, parent)
+		p.stack = p.stack[:len(p.stack)-1]
 
 		if err != nil {
 			debug("Error:", err)
@@ -139,6 +296,7 @@ restart:
 		korder[0] = string(t.val)
 		themap[KeyOrder] = korder
 		themap[string(t.val)] = res
+		p.setMapOrigins(themap, string(t.val), []*Origin{p.origin(t)})
 		return themap, nil
 
 	case SEMICOL:
@@ -189,6 +347,8 @@ restart:
 }
 
 func (p *Parser) parselist(t *tag, parent []interface{}) (ret interface{}, err error) {
+	var elems []*Origin
+
 	// Parse until bracket close
 restart:
 	if t == nil {
@@ -201,6 +361,7 @@ restart:
 	switch t.state {
 	case BRACKETCLOSE:
 		// list finished
+		p.recordList(parent, elems)
 		return parent, nil
 
 	case SEMICOL, COLON, EQUAL:
@@ -221,7 +382,13 @@ restart:
 			if restag, ok := res.(*tag); ok {
 				// result is a tag; parsevalue didn't handle it
 				if restag.state == BRACKETCLOSE {
-					parent = append(parent, string(restag.val))
+					v, err := p.leafvalue(restag)
+					if err != nil {
+						return nil, err
+					}
+					parent = append(parent, v)
+					elems = append(elems, p.origin(restag))
+					p.recordList(parent, elems)
 					return parent, nil
 				} else {
 					return nil, fmt.Errorf("Unexpected tag %s, line %d\n",
@@ -230,12 +397,93 @@ restart:
 			}
 
 			parent = append(parent, res)
+			elems = append(elems, p.origin(t))
 		}
 		t = nil
 		goto restart
 	}
 }
 
+// Set key k of themap to v, from o, or append v to k's values if it exists.
+// Values of a higher priority replace those of a lower one, which are
+// otherwise ignored, and any value replaces an inherited one.
+func (p *Parser) addValue(themap map[string] interface{}, k string,
+                          v interface{}, o *Origin) error {
+	key := mapOriginKey(themap, k)
+	r := p.origins[key]
+	prev, inherited := r.origins, r.inherited
+	r.origins, r.inherited, r.container = append(prev, o), false, themap
+	p.origins[key] = r
+	if inherited {
+		for _, po := range prev {
+			po.Overridden = true
+		}
+		p.forget(themap[k])
+		themap[k] = v
+		return nil
+	}
+	for _, po := range prev {
+		if po.Overridden {
+			continue
+		}
+		if po.Priority > o.Priority {
+			o.Overridden = true
+			p.forget(v)
+			return nil
+		}
+		if po.Priority < o.Priority {
+			for _, po := range prev {
+				po.Overridden = true
+			}
+			p.forget(themap[k])
+			themap[k] = v
+			return nil
+		}
+	}
+
+	korder_intf, ok := themap[KeyOrder]
+	var korder []string
+	if !ok {
+		if UclExportKeyOrder {
+			// only initialize if requested
+			korder = make([]string, 0, 16)
+		}
+	} else {
+		korder, ok = korder_intf.([]string)
+		if !ok {
+			debug("key order is not slice")
+			return fmt.Errorf("map[--keyorder--] is not slice")
+		}
+	}
+
+	if mapitems, ok := themap[k]; ok {
+		if childarray, ok := mapitems.([]interface{}); ok {
+			// already an array, so append
+			nchildarray := append(childarray, v)
+			p.appendOrigin(childarray, nchildarray, o)
+			themap[k] = nchildarray
+		} else {
+			childarray := make([]interface{}, 1, 2)
+			childarray[0] = themap[k]
+			if len(prev) > 0 {
+				p.recordList(childarray, prev[len(prev)-1:])
+			}
+			nchildarray := append(childarray, v)
+			p.appendOrigin(childarray, nchildarray, o)
+			themap[k] = nchildarray
+		}
+	} else {
+		// doesn't exist
+		if cap(korder) != 0 {
+			// only update KeyOrder if it was initialized
+			korder = append(korder, k)
+			themap[KeyOrder] = korder
+		}
+		themap[k] = v
+	}
+	return nil
+}
+
 func (p *Parser) parse(t *tag, parent interface{}) (ret interface{}, err error) {
 	defer func() {
 		p.err = err
@@ -260,22 +508,28 @@ restart:
 			panic("...")
 		}
 
-		korder_intf, ok := themap[KeyOrder]
-		var korder []string
-		if !ok {
-			if UclExportKeyOrder {
-				// only initialize if requested
-				korder = make([]string, 0, 16)
+		kt := t
+
+		// a .macro's argument is taken as written
+		var m *macroCall
+		flags := p.flags
+		if t.state == TAG {
+			if m, err = p.parseMacro(t); err != nil {
+				return nil, err
 			}
-		} else {
-			korder, ok = korder_intf.([]string)
-			if !ok {
-				debug("key order is not slice")
-				return nil, fmt.Errorf("map[--keyorder--] is not slice")
+			if m != nil {
+				p.flags = 0
 			}
 		}
 
+		if m == nil {
+			p.stack = append(p.stack, k)
+		}
 		res, err := p.parsevalue(nil, nil)
+		p.flags = flags
+		if m == nil {
+			p.stack = p.stack[:len(p.stack)-1]
+		}
 		if err != nil {
 			if restag, ok := res.(*tag); ok {
 				if restag.state == SEMICOL {
@@ -292,29 +546,23 @@ restart:
 				t = restag
 				goto restart
 			}
-			res = string(restag.val)
+			if m != nil {
+				p.flags = 0
+			}
+			res, err = p.leafvalue(restag)
+			p.flags = flags
+			if err != nil {
+				return nil, err
+			}
 			t = restag
 		}
 
-		if mapitems, ok := themap[k]; ok {
-			if childarray, ok := mapitems.([]interface{}); ok {
-				// already an array, so append
-				childarray = append(childarray, res)
-				themap[k] = childarray
-			} else {
-				childarray := make([]interface{}, 1, 2)
-				childarray[0] = themap[k]
-				childarray = append(childarray, res)
-				themap[k] = childarray
-			}
-		} else {
-			// doesn't exist
-			if cap(korder) != 0 {
-				// only update KeyOrder if it was initialized
-				korder = append(korder, k)
-				themap[KeyOrder] = korder
+		if m != nil {
+			if err = p.runMacro(m, themap, res); err != nil {
+				return nil, err
 			}
-			themap[k] = res
+		} else if err = p.addValue(themap, k, res, p.origin(kt)); err != nil {
+			return nil, err
 		}
 		if t.state == BRACECLOSE {
 			// map completed
@@ -347,7 +595,9 @@ restart:
 				return nil, fmt.Errorf("Invalid {, parent not nil|map|list")
 			}
 		}
+		p.stack = append(p.stack, theparent)
 		res, err := p.parse(nil, theparent)
+		p.stack = p.stack[:len(p.stack)-1]
 		if err != nil {
 			debug("Error parsing brace", err)
 		}
@@ -372,10 +622,16 @@ restart:
 
 
 func (p *Parser) Ucl() (map[string] interface{}, error) {
+	if p.stack == nil {
+		p.stack = []interface{}{p.ucl}
+	}
 	p.parse(nil, p.ucl)
 
 	if p.err == io.EOF {
 		p.err = nil
 	}
+	if p.err == nil && p.depth == 0 && p.flags & ParseReferences != 0 {
+		p.err = p.interpolate()
+	}
 	return p.ucl, p.err
 }
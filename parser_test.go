@@ -32,6 +32,8 @@ import (
 	"testing"
 	"encoding/json"
 	"bytes"
+	"regexp"
+	"strings"
 	"time"
 	"os"
 	"io"
@@ -225,3 +227,257 @@ EODX;
 	Encode(&ibuf, &ss, "   ", "json", `""`)
 	t.Log("\n" + ibuf.String())
 }
+
+func TestParseNumbers(t *testing.T) {
+	s := `
+int 42;
+neg -7;
+big 9007199254740993;
+huge 18446744073709551615;
+float 1.5;
+exp 1e6;
+nan nan;
+quoted "42";
+version 1.2.3;
+list [ 1, 2.5 ];
+obj { x 3 }
+`
+	p := NewParserFlags(bytes.NewBufferString(s), ParseNumbers)
+	ucl, err := p.Ucl()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expect := map[string] interface{}{
+		"int":     int64(42),
+		"neg":     int64(-7),
+		"big":     int64(9007199254740993),
+		"huge":    uint64(18446744073709551615),
+		"float":   1.5,
+		"exp":     1e6,
+		"quoted":  "42",
+		"version": "1.2.3",
+	}
+	for k, v := range expect {
+		if ucl[k] != v {
+			t.Errorf("%s: got %T %v, want %T %v", k, ucl[k], ucl[k], v, v)
+		}
+	}
+	if f, ok := ucl["nan"].(float64); !ok || f == f {
+		t.Errorf("nan: got %T %v", ucl["nan"], ucl["nan"])
+	}
+	list := ucl["list"].([]interface{})
+	if list[0] != int64(1) || list[1] != 2.5 {
+		t.Errorf("list: got %v", list)
+	}
+	if obj := ucl["obj"].(map[string] interface{}); obj["x"] != int64(3) {
+		t.Errorf("obj: got %T %v", obj["x"], obj["x"])
+	}
+
+	p = NewParserFlags(bytes.NewBufferString(s), ParseUseNumber)
+	if ucl, err = p.Ucl(); err != nil {
+		t.Fatal(err)
+	}
+	if ucl["exp"] != Number("1e6") || ucl["quoted"] != "42" {
+		t.Errorf("got %T %v and %T %v", ucl["exp"], ucl["exp"],
+		         ucl["quoted"], ucl["quoted"])
+	}
+}
+
+func TestParseNumberForms(t *testing.T) {
+	s := `
+mask = 0xff00;
+neg -0x10;
+perm = 0o755;
+bits 0b1010;
+big 1_000_000;
+float 1_000.5;
+name my_var;
+`
+	p := NewParserFlags(bytes.NewBufferString(s), ParseNumbers)
+	ucl, err := p.Ucl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string] interface{}{
+		"mask": int64(0xff00),
+		"neg":  int64(-16),
+		"perm": "0o755",
+		"bits": "0b1010",
+		"big":  "1_000_000",
+		"name": "my_var",
+	}
+	for k, v := range expect {
+		if ucl[k] != v {
+			t.Errorf("%s: got %T %v, want %T %v", k, ucl[k], ucl[k], v, v)
+		}
+	}
+
+	p = NewParserFlags(bytes.NewBufferString(s),
+	                   ParseNumbers | ParseGoNumbers)
+	if ucl, err = p.Ucl(); err != nil {
+		t.Fatal(err)
+	}
+	expect = map[string] interface{}{
+		"perm":  int64(0755),
+		"bits":  int64(10),
+		"big":   int64(1000000),
+		"float": 1000.5,
+		"name":  "my_var",
+	}
+	for k, v := range expect {
+		if ucl[k] != v {
+			t.Errorf("%s: got %T %v, want %T %v", k, ucl[k], ucl[k], v, v)
+		}
+	}
+
+	// Number keeps the literal, and converts it on request
+	p = NewParserFlags(bytes.NewBufferString(s),
+	                   ParseUseNumber | ParseGoNumbers)
+	if ucl, err = p.Ucl(); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ucl["perm"].(Number).Int64(); ucl["perm"] != Number("0o755") ||
+	   err != nil || n != 0755 {
+		t.Errorf("perm: got %v %v %v", ucl["perm"], n, err)
+	}
+	var perm struct {
+		Perm uint32 `ucl:"perm"`
+		Mask uint16 `ucl:"mask"`
+	}
+	if err = Decode(ucl, &perm, "ucl"); err != nil || perm.Perm != 0755 ||
+	   perm.Mask != 0xff00 {
+		t.Errorf("decode: got %+v %v", perm, err)
+	}
+
+	bad := []struct {
+		s   string
+		err string
+	}{
+		{"mask = 0xfg00;", `malformed number "0xfg00" at line 1 column 11`},
+		{"mask 0x;", `malformed number "0x" at line 1 column 8`},
+		{"x {\n  perm 0o758\n}", `malformed number "0o758" at line 2 column 12`},
+		{"big 1__000;", `malformed number "1__000" at line 1 column 6`},
+		{"big 1000_;", `malformed number "1000_" at line 1 column 9`},
+		{"list [ 1, 0b102 ]", `malformed number "0b102" at line 1 column 15`},
+		{"big _1000;", `malformed number "_1000" at line 1 column 5`},
+		{"neg -_5;", `malformed number "-_5" at line 1 column 6`},
+		{"neg -5_;", `malformed number "-5_" at line 1 column 7`},
+	}
+	for i := range bad {
+		p = NewParserFlags(bytes.NewBufferString(bad[i].s),
+		                   ParseNumbers | ParseGoNumbers)
+		_, err = p.Ucl()
+		if err == nil || err.Error() != bad[i].err {
+			t.Errorf("%q: got error %v, want %s", bad[i].s, err, bad[i].err)
+		}
+	}
+
+	// a separator may follow a base prefix
+	p = NewParserFlags(bytes.NewBufferString("mask 0x_ff; neg -0b_1;"),
+	                   ParseNumbers | ParseGoNumbers)
+	if ucl, err = p.Ucl(); err != nil || ucl["mask"] != int64(255) ||
+	   ucl["neg"] != int64(-1) {
+		t.Errorf("prefixed separators: got %v %v", ucl, err)
+	}
+}
+
+func TestParseRegex(t *testing.T) {
+	s := `
+match /^[a-z]{2,}\d+$/i;
+slashed /a\/b/;
+path /var/log;
+dir /tmp;
+sect { dir /tmp }
+quoted "/x/";
+list [ /ab+c/, /x\ y/, /[;]/ ]
+`
+	p := NewParserFlags(bytes.NewBufferString(s), ParseRegex)
+	ucl, err := p.Ucl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := map[string] interface{}{
+		"match":   Regex{`^[a-z]{2,}\d+$`, "i"},
+		"slashed": Regex{`a\/b`, ""},
+		"path":    "/var/log",
+		"dir":     "/tmp",
+		"quoted":  "/x/",
+	}
+	for k, v := range expect {
+		if ucl[k] != v {
+			t.Errorf("%s: got %T %v, want %T %v", k, ucl[k], ucl[k], v, v)
+		}
+	}
+	if sect := ucl["sect"].(map[string] interface{}); sect["dir"] != "/tmp" {
+		t.Errorf("sect.dir: got %v", sect["dir"])
+	}
+	list := ucl["list"].([]interface{})
+	if len(list) != 3 || list[0] != (Regex{"ab+c", ""}) {
+		t.Errorf("list: got %v", list)
+	}
+
+	var cfg struct {
+		Match   *regexp.Regexp `ucl:"match"`
+		Slashed regexp.Regexp  `ucl:"slashed"`
+		Path    *regexp.Regexp `ucl:"path"`
+		Raw     Regex          `ucl:"match"`
+	}
+	if err = Decode(ucl, &cfg, "ucl"); err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Match.MatchString("AB12") || cfg.Match.MatchString("a1") ||
+	   !cfg.Slashed.MatchString("a/b") || !cfg.Path.MatchString("/var/log") ||
+	   cfg.Raw.Flags != "i" {
+		t.Errorf("unexpected decode: %v %v %v %v", cfg.Match, &cfg.Slashed,
+		         cfg.Path, cfg.Raw)
+	}
+
+	p = NewParserFlags(bytes.NewBufferString("x {\n  bad /a(b/;\n}"),
+	                   ParseRegex)
+	_, err = p.Ucl()
+	if err == nil || !strings.HasPrefix(err.Error(),
+	                    "invalid regex /a(b/ at line 2 column 7:") {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestParseHeredocDedent(t *testing.T) {
+	s := "section {\n" +
+	     "\tplain = <<EOD\n" +
+	     "  kept\n" +
+	     "  EOD\n" +
+	     "EOD\n" +
+	     "\tindented = <<-EOD\n" +
+	     "\t\tfirst\n" +
+	     "\t\t  second\n" +
+	     "\n" +
+	     "\t\tthird; EOD\n" +
+	     "\tEOD;\n" +
+	     "\tempty <<-EOD\n" +
+	     "\t\tEOD\n" +
+	     "}\n" +
+	     "after = 1;\n"
+	p := NewParser(bytes.NewBufferString(s))
+	ucl, err := p.Ucl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sect, ok := ucl["section"].(map[string] interface{})
+	if !ok {
+		t.Fatalf("section: got %v", ucl)
+	}
+	expect := map[string] string{
+		"plain":    "  kept\n  EOD",
+		"indented": "first\n  second\n\nthird; EOD",
+		"empty":    "",
+	}
+	for k, v := range expect {
+		if got, _ := sect[k].(string); got != v {
+			t.Errorf("%s: got %q, want %q", k, sect[k], v)
+		}
+	}
+	if ucl["after"] != "1" {
+		t.Errorf("after: got %v", ucl["after"])
+	}
+}
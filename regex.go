@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A Regex is a /regular expression/ value, returned in place of a string
+// when parsing with ParseRegex.
+type Regex struct {
+	Source string   // the pattern between the slashes
+	Flags  string   // flags after the closing slash: any of i, m, s and U
+}
+
+// Flags accepted after a regex, as understood by Go's regexp package
+const regexFlags = "imsU"
+
+// Split a /source/flags literal; ok is false if s is not one, e.g. a path
+// such as /var/log (where "log" are not flags) or an empty //.
+func splitRegex(s string) (source, flags string, ok bool) {
+	if len(s) < 3 || s[0] != '/' {
+		return "", "", false
+	}
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '/':
+			flags = s[i+1:]
+			for j := 0; j < len(flags); j++ {
+				if strings.IndexByte(regexFlags, flags[j]) < 0 {
+					return "", "", false
+				}
+			}
+			return s[1:i], flags, i > 1
+		}
+	}
+	return "", "", false
+}
+
+// Returns the regex in the /source/flags form. Slashes, whitespace and ';'
+// in the source are escaped so that it reads back as a single value.
+func (r Regex) String() string {
+	var b strings.Builder
+	b.WriteByte('/')
+	for i := 0; i < len(r.Source); i++ {
+		c := r.Source[i]
+		switch {
+		case c == '\\' && i+1 < len(r.Source):
+			b.WriteByte(c)
+			i++
+			b.WriteByte(r.Source[i])
+		case c == '/' || c == ';':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c <= ' ':
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('/')
+	b.WriteString(r.Flags)
+	return b.String()
+}
+
+// Compiles the regex with Go's regexp package, applying its flags.
+func (r Regex) Compile() (*regexp.Regexp, error) {
+	if r.Flags != "" {
+		return regexp.Compile("(?" + r.Flags + ")" + r.Source)
+	}
+	return regexp.Compile(r.Source)
+}
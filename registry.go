@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// The concrete types that values of an interface type decode into, chosen
+// by the value of their discriminator key
+type typeRegistry struct {
+	key   string
+	types map[string] reflect.Type
+}
+
+// How a registered type is told apart, e.g. type = http
+type typeName struct {
+	key, value string
+}
+
+var (
+	registryLock sync.RWMutex
+	registries   = make(map[reflect.Type] *typeRegistry) // by interface
+	typeNames    = make(map[reflect.Type] typeName)      // by struct
+)
+
+// Register v's type as the one that an object decodes into, when decoding
+// into the interface type that iface points to, if the object's key has
+// value, e.g.
+//   RegisterType((*Stage)(nil), "type", "http", &HTTPStage{})
+// makes stage { type = http; url = ...; } an *HTTPStage in a Stage field.
+// v may be a struct or a pointer to one, as implements the interface. The
+// encoder writes key = value into objects of the type, so a struct may be
+// registered with other interfaces only under the same key and value.
+func RegisterType(iface interface{}, key, value string, v interface{}) error {
+	it := reflect.TypeOf(iface)
+	if it == nil || it.Kind() != reflect.Ptr || it.Elem().Kind() != reflect.Interface {
+		return fmt.Errorf("cannot register types for %T, which is not a " +
+		                  "pointer to an interface", iface)
+	}
+	it = it.Elem()
+	t := reflect.TypeOf(v)
+	if t == nil || !t.Implements(it) {
+		return fmt.Errorf("%T does not implement %s", v, it)
+	}
+	st := t
+	if st.Kind() == reflect.Ptr {
+		st = st.Elem()
+	}
+	if st.Kind() != reflect.Struct {
+		return fmt.Errorf("cannot register %T, which is not a struct", v)
+	}
+
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	r := registries[it]
+	if r != nil && r.key != key {
+		return fmt.Errorf("%s is told apart by %s, not %s", it, r.key, key)
+	}
+	if r != nil {
+		if pt, ok := r.types[value]; ok && pt != t {
+			return fmt.Errorf("%s %q of %s is already %s", key, value, it, pt)
+		}
+	}
+	// the encoder writes one discriminator for a struct, whichever
+	// interface it is held by
+	n := typeName{key, value}
+	if pn, ok := typeNames[st]; ok && pn != n {
+		return fmt.Errorf("%s is already registered as %s %q", st, pn.key,
+		                  pn.value)
+	}
+
+	if r == nil {
+		r = &typeRegistry{key: key, types: make(map[string] reflect.Type)}
+		registries[it] = r
+	}
+	r.types[value] = t
+	typeNames[st] = n
+	return nil
+}
+
+func registryOf(t reflect.Type) *typeRegistry {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	return registries[t]
+}
+
+// The discriminator of struct type t, if it is registered
+func typeNameOf(t reflect.Type) (typeName, bool) {
+	registryLock.RLock()
+	defer registryLock.RUnlock()
+	n, ok := typeNames[t]
+	return n, ok
+}
+
+// Decode object m into interface v, as the type registered in r for m's
+// discriminator
+func (d *decoder) decodeRegistered(r *typeRegistry, m map[string] interface{},
+                                   v reflect.Value, path string) error {
+	k, ok := lookupKey(m, r.key)
+	if !ok {
+		return fmt.Errorf("%s: missing %s", joinPath(path, r.key), r.key)
+	}
+	value := fmt.Sprint(m[k])
+	registryLock.RLock()
+	t, ok := r.types[value]
+	registryLock.RUnlock()
+	if !ok {
+		return fmt.Errorf("%s: unknown %s %q", joinPath(path, k), r.key, value)
+	}
+
+	nv := reflect.New(t).Elem()
+	n := len(d.unknown)
+	if err := d.decode(m, nv, path); err != nil {
+		return err
+	}
+	// the discriminator is known, whether or not a field holds it
+	for i := n; i < len(d.unknown); i++ {
+		if d.unknown[i].Path == joinPath(path, k) {
+			d.unknown = append(d.unknown[:i], d.unknown[i+1:]...)
+			break
+		}
+	}
+	v.Set(nv)
+	return nil
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+type testStage interface {
+	run() string
+}
+
+type httpStage struct {
+	URL string `ucl:"url"`
+}
+
+func (s *httpStage) run() string { return s.URL }
+
+type execStage struct {
+	Kind string   `ucl:"type"`
+	Args []string `ucl:"args"`
+}
+
+func (s execStage) run() string { return s.Kind }
+
+type testPipeline struct {
+	Stages []testStage `ucl:"stage"`
+}
+
+func TestRegisterType(t *testing.T) {
+	if err := RegisterType((*testStage)(nil), "type", "http", &httpStage{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterType((*testStage)(nil), "type", "exec", execStage{}); err != nil {
+		t.Fatal(err)
+	}
+
+	s := `
+stage {
+	type = http;
+	url = "http://example.com/";
+}
+stage {
+	type = exec;
+	args = [a, b];
+}
+`
+	p := NewParser(bytes.NewBufferString(s))
+	if _, err := p.Ucl(); err != nil {
+		t.Fatal(err)
+	}
+	var pipeline testPipeline
+	if _, err := p.Decode(&pipeline, "ucl", DisallowUnknownKeys); err != nil {
+		t.Fatal(err)
+	}
+	expect := testPipeline{[]testStage{
+		&httpStage{URL: "http://example.com/"},
+		execStage{Kind: "exec", Args: []string{"a", "b"}},
+	}}
+	if !reflect.DeepEqual(pipeline, expect) {
+		t.Fatalf("got %+v", pipeline)
+	}
+
+	var buf bytes.Buffer
+	if err := Encode(&buf, &pipeline, "\t", "ucl", ""); err != nil {
+		t.Fatal(err)
+	}
+	out := `stage [
+	{
+		type http;
+		url "http://example.com/";
+	},
+	{
+		type exec;
+		args [
+			a,
+			b
+		];
+	}
+];
+`
+	if buf.String() != out {
+		t.Errorf("unexpected output: %s", buf.String())
+	}
+	var again testPipeline
+	if err := Decode(parseString(t, buf.String()), &again, "ucl"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, expect) {
+		t.Errorf("round trip: got %+v", again)
+	}
+
+	errors := map[string] string{
+		"stage { url = x; }\nstage { url = y; }":
+			"stage[0].type: missing type",
+		"stage { type = ftp; }\nstage { type = http; }":
+			`stage[0].type: unknown type "ftp"`,
+	}
+	for in, expect := range errors {
+		var pipeline testPipeline
+		err := Decode(parseString(t, in), &pipeline, "ucl")
+		if err == nil || err.Error() != expect {
+			t.Errorf("%s: unexpected error: %v", in, err)
+		}
+	}
+
+	regErrors := map[string] error{
+		"not interface": RegisterType(httpStage{}, "type", "x", &httpStage{}),
+		"not implemented": RegisterType((*testStage)(nil), "type", "x",
+		                                httpStage{}),
+		"other key": RegisterType((*testStage)(nil), "kind", "x", &httpStage{}),
+		"taken": RegisterType((*testStage)(nil), "type", "http", execStage{}),
+		"renamed": RegisterType((*testStage)(nil), "type", "web",
+		                        &httpStage{}),
+		"other interface": RegisterType((*testRunner)(nil), "kind", "exec",
+		                                execStage{}),
+	}
+	for name, err := range regErrors {
+		if err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+	if registryOf(reflect.TypeOf((*testRunner)(nil)).Elem()) != nil {
+		t.Errorf("failed registration left a registry")
+	}
+
+	// the same name under another interface is fine
+	err := RegisterType((*testWorker)(nil), "type", "exec", execStage{})
+	if err != nil {
+		t.Errorf("same name, other interface: %v", err)
+	}
+	if n, _ := typeNameOf(reflect.TypeOf(execStage{})); n.value != "exec" {
+		t.Errorf("got name %v", n)
+	}
+}
+
+type testRunner interface {
+	run() string
+}
+
+type testWorker interface {
+	run() string
+}
@@ -65,6 +65,7 @@ const (
 	MAYBE_MLSTRING2
 	MLSTRING_PREP
 	MLSTRING_HEADER_OK
+	REGEX_FLAGS      // flags after the closing slash of a regex
 )
 
 const (
@@ -77,6 +78,9 @@ type tag struct {
 	state int
 
 	flag  int       // used by parser
+
+	line  int       // position of the tag in the input
+	col   int
 }
 
 var UnexpectedEOF = errors.New("Unexpected EOF")
@@ -96,10 +100,29 @@ type scanner struct {
 	skipsep int
 
 	line   int       // current input line
+	col    int       // column of the current character in its line
+	prevcol int      // column before the current character, for unread()
+	tagline int      // where the current tag commenced
+	tagcol  int
 
 	mlstring_tag []byte // "EOD" tag of ML string
+	mldedent bool       // <<-EOD: indented "EOD", strip common indentation
 	curline []byte
 
+	// within a /regex/ value of a TAG, and its nesting of {} and []
+	inregex  bool
+	rxescape bool
+	rxbrace  int
+	rxbracket int
+
+	// within a ${reference} of a TAG
+	inref    bool
+
+	// within the (params) of a .macro key, and any quote inside them
+	inparen  bool
+	pnquote  byte
+	pnescape bool
+
 	err    error
 }
 
@@ -155,8 +178,132 @@ func (s *scanner) discard() {
 	s.curtag = make([]byte, 0, 1024)
 }
 
+// Note that the current character commences a new tag
+func (s *scanner) mark() {
+	s.tagline = s.line
+	s.tagcol = s.col
+}
+
+// Push back the character just read, so that it is scanned again
+func (s *scanner) unread(c byte) {
+	s.bufi--
+	if c == '\n' {
+		s.line--
+		s.col = s.prevcol
+	} else {
+		s.col--
+	}
+}
+
+// Within a /regex/ value in a TAG, characters that would otherwise end or
+// split the tag are taken literally, up to the closing slash. A '}' or ']'
+// that is not balanced within the regex, ';' and newline still end it, so
+// that unquoted paths such as "/tmp;" or "{ dir /tmp }" read as before.
+// Returns false if c is to be handled as usual.
+func (s *scanner) regexchar(c byte) bool {
+	if c == '\n' {
+		s.inregex = false
+		return false
+	}
+	if s.rxescape {
+		s.rxescape = false
+		s.curtag = append(s.curtag, c)
+		return true
+	}
+
+	switch c {
+	case ';':
+		if s.rxbracket == 0 {
+			s.inregex = false
+			return false
+		}
+	case '\\':
+		s.rxescape = true
+	case '/':
+		s.inregex = false
+	case '{':
+		s.rxbrace++
+	case '}':
+		if s.rxbrace == 0 {
+			s.inregex = false
+			return false
+		}
+		s.rxbrace--
+	case '[':
+		s.rxbracket++
+	case ']':
+		if s.rxbracket == 0 {
+			s.inregex = false
+			return false
+		}
+		s.rxbracket--
+	}
+	s.curtag = append(s.curtag, c)
+	return true
+}
+
+// Remove the longest run of leading spaces and tabs common to all lines
+// of a <<-EOD string; lines holding only whitespace are not considered,
+// and are emptied if shorter than that indentation.
+func dedent(b []byte) []byte {
+	lines := bytes.Split(b, []byte{'\n'})
+	var prefix []byte
+	first := true
+	for _, l := range lines {
+		ws := l[:len(l)-len(bytes.TrimLeft(l, " \t"))]
+		if len(ws) == len(l) {
+			continue
+		}
+		if first {
+			prefix = ws
+			first = false
+			continue
+		}
+		n := 0
+		for n < len(prefix) && n < len(ws) && prefix[n] == ws[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+
+	for i, l := range lines {
+		if bytes.HasPrefix(l, prefix) {
+			lines[i] = l[len(prefix):]
+		} else {
+			lines[i] = l[:0]
+		}
+	}
+	return bytes.Join(lines, []byte{'\n'})
+}
+
+// Add c to the (params) of a .macro key, which end at the first ')' outside
+// of quotes
+func (s *scanner) parenchar(c byte) {
+	s.curtag = append(s.curtag, c)
+	switch {
+	case s.pnescape:
+		s.pnescape = false
+	case s.pnquote != 0:
+		if c == '\\' {
+			s.pnescape = true
+		} else if c == s.pnquote {
+			s.pnquote = 0
+		}
+	case c == '"' || c == '\'':
+		s.pnquote = c
+	case c == ')':
+		s.inparen = false
+	}
+}
+
 func (s *scanner) maketag(v []byte, state int) (t *tag) {
 	t = new(tag)
+	t.line = s.tagline
+	t.col = s.tagcol
+	s.inregex = false
+	s.rxbracket = 0
+	s.inparen = false
+	s.inref = false
 	if v != nil {
 		if len(v) > 0 {
 			t.val = make([]byte, len(v))
@@ -179,7 +326,8 @@ func (s *scanner) maketag(v []byte, state int) (t *tag) {
 		}
 		t.val = []byte(qs)
 		s.curtag = s.curtag[:0]
-	} else if len(s.curtag) > 0 {
+	} else if len(s.curtag) > 0 || s.state == MLSTRING {
+		// a heredoc may be empty
 		t.state = s.state
 		t.val = s.curtag
 		s.curtag = make([]byte, 0, 1024)
@@ -216,8 +364,12 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 		c := s.buf[s.bufi]
 		s.bufi++
 
+		s.prevcol = s.col
 		if c == '\n' {
 			s.line++
+			s.col = 0
+		} else {
+			s.col++
 		}
 
 		switch s.state {
@@ -249,6 +401,7 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 				*/
 			}
 
+			s.mark()
 			if c != '"' && c != '\'' {
 				s.curtag = append(s.curtag, c)
 			}
@@ -353,6 +506,32 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 			// read until either ; { or '\n'
 			// if {, then split tag into different keys and send each tag
 			// as a TAG
+			if s.inregex && s.regexchar(c) {
+				break
+			}
+			if s.inparen {
+				s.parenchar(c)
+				break
+			}
+			if s.inref {
+				// up to the closing '}' of ${reference}
+				s.curtag = append(s.curtag, c)
+				if c == '}' {
+					s.inref = false
+				} else if c == '\n' || c == ';' {
+					s.inref = false
+					s.curtag = s.curtag[:len(s.curtag)-1]
+					s.unread(c)
+				}
+				break
+			}
+			if c == '{' && len(s.curtag) > 0 &&
+			   s.curtag[len(s.curtag)-1] == '$' {
+				s.curtag = append(s.curtag, c)
+				s.inref = true
+				break
+			}
+
 			if len(s.curtag) > 0 {
 				if s.curtag[len(s.curtag)-1] == '<' {
 					// possibly multiline string if next character
@@ -366,14 +545,19 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 			if c == '{' {
 				// split up tag into individual strings, separated by ' '
 				fields := strings.Split(string(s.curtag), " ")
+				col := s.tagcol
 				for f := range fields {
 					if fields[f] != "" {
-						tags = append(tags, s.maketag([]byte(fields[f]), TAG))
+						t := s.maketag([]byte(fields[f]), TAG)
+						t.col = col
+						tags = append(tags, t)
 						if s.err != nil {
 							return nil, s.err
 						}
 					}
+					col += len(fields[f]) + 1
 				}
+				s.mark()
 				s.curtag = s.curtag[:0]
 				s.curtag = append(s.curtag, c)
 				s.scopeadd(c)
@@ -404,6 +588,7 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 					panic("shouldn't happen")
 				}
 
+				s.mark()
 				tags = append(tags, s.maketag([]byte("}"), BRACECLOSE))
 				if s.err != nil {
 					return nil, s.err
@@ -423,6 +608,7 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 					}
 				}
 				s.curtag = s.curtag[:0]
+				s.mark()
 				if c == '\'' {
 					s.state = VQUOTE
 				} else {
@@ -433,14 +619,19 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 			} else if c == '[' {
 				// split up tag into individual strings, separated by ' '
 				fields := strings.Split(string(s.curtag), " ")
+				col := s.tagcol
 				for f := range fields {
 					if fields[f] != "" {
-						tags = append(tags, s.maketag([]byte(fields[f]), TAG))
+						t := s.maketag([]byte(fields[f]), TAG)
+						t.col = col
+						tags = append(tags, t)
 						if s.err != nil {
 							return nil, s.err
 						}
 					}
+					col += len(fields[f]) + 1
 				}
+				s.mark()
 				s.curtag = s.curtag[:0]
 				s.curtag = append(s.curtag, c)
 				s.scopeadd(c)
@@ -470,6 +661,7 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 				if !s.scopereduce(c) {
 					panic("shouldn't happen")
 				}
+				s.mark()
 				tags = append(tags, s.maketag([]byte("]"), BRACKETCLOSE))
 				if s.err != nil {
 					return nil, s.err
@@ -560,6 +752,9 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 					s.state = TAG
 					s.skipsep &= ^skip_sep
 				} else {
+					if len(s.curtag) == 0 {
+						s.mark()
+					}
 					s.curtag = append(s.curtag, c)
 					s.skipsep &= ^skip_white
 				}
@@ -569,6 +764,20 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 					s.line)
 
 			} else {
+				if len(s.curtag) == 0 {
+					s.mark()
+					if c == '/' {
+						s.inregex = true
+						s.rxescape = false
+						s.rxbrace = 0
+						s.rxbracket = 0
+					}
+				} else if c == '(' && s.curtag[0] == '.' {
+					// .macro(params)
+					s.inparen = true
+					s.pnquote = 0
+					s.pnescape = false
+				}
 				s.curtag = append(s.curtag, c)
 				if len(tags) > 0 {
 					s.skipsep &= ^skip_white
@@ -577,12 +786,18 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 
 		case MAYBE_MLSTRING:
 			s.curtag = append(s.curtag, c)
+			if c == '-' && !s.mldedent &&
+			   bytes.HasSuffix(s.curtag, []byte("<<-")) {
+				s.mldedent = true
+				break
+			}
 			if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' ||
 			   c >= '0' && c <= '9' {
 				s.state = MLSTRING_PREP
 				s.curline = make([]byte, 0, 128)
 				s.curline = append(s.curline, c)
 			} else {
+				s.mldedent = false
 				s.state = TAG
 			}
 
@@ -649,9 +864,23 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 				s.curline = make([]byte, 0, 128)
 			}
 			if c == ';' || c == '\n' {
-				if bytes.Equal(s.curline, s.mlstring_tag) {
+				// "EOD" must start the line, after any indentation
+				// for <<-EOD
+				eod := s.curline
+				if s.mldedent {
+					eod = bytes.TrimLeft(eod, " \t")
+				}
+				bol := len(s.curtag) == 0 ||
+				       s.curtag[len(s.curtag)-1] == '\n'
+				if bol && bytes.Equal(eod, s.mlstring_tag) {
 					// "EOD" reached
-					s.curtag = s.curtag[:len(s.curtag)-1]
+					if len(s.curtag) > 0 {
+						s.curtag = s.curtag[:len(s.curtag)-1]
+					}
+					if s.mldedent {
+						s.curtag = dedent(s.curtag)
+						s.mldedent = false
+					}
 					tags = append(tags, s.maketag(nil, 0))
 					if s.err != nil {
 						return nil, s.err
@@ -681,6 +910,9 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 				s.curtag = append(s.curtag, c)
 				if c == '\n' {
 					s.line++
+					s.col = 0
+				} else {
+					s.col++
 				}
 				s.bufi++
 
@@ -706,11 +938,18 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 			} else {
 				if c == '\\' {
 					// Escape sequence
-					if s.bufi+1 < s.bufmax {
+					if s.bufi < s.bufmax {
+						s.curtag = append(s.curtag, c)
+						c = s.buf[s.bufi]
 						s.curtag = append(s.curtag, c)
 						s.bufi++
-						s.curtag = append(s.curtag, s.buf[s.bufi])
-						s.bufi++
+						s.prevcol = s.col
+						if c == '\n' {
+							s.line++
+							s.col = 0
+						} else {
+							s.col++
+						}
 						break
 					}
 				}
@@ -718,6 +957,11 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 				switch c {
 				case '/':
 					s.curtag = append(s.curtag, c)
+					if len(s.curtag) > 2 {
+						// closing slash; pick up any flags
+						s.state = REGEX_FLAGS
+						break
+					}
 					tags = append(tags, s.maketag(nil, 0))
 					if s.err != nil {
 						return nil, s.err
@@ -742,7 +986,22 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 					s.state = WHITESPACE
 					return tags, nil
 
+				case '[':
+					s.rxbracket++
+					s.curtag = append(s.curtag, c)
+
+				case ']':
+					if s.rxbracket > 0 {
+						s.rxbracket--
+					}
+					s.curtag = append(s.curtag, c)
+
 				case ';':
+					if s.rxbracket > 0 {
+						// part of a character class
+						s.curtag = append(s.curtag, c)
+						break
+					}
 					s.state = TAG
 					tags = append(tags, s.maketag(nil, 0))
 					if s.err != nil {
@@ -757,6 +1016,20 @@ func (s *scanner) nexttags() (tags []*tag, err error) {
 				}
 			}
 
+		case REGEX_FLAGS:
+			if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' {
+				s.curtag = append(s.curtag, c)
+				break
+			}
+			s.state = SLASH
+			tags = append(tags, s.maketag(nil, 0))
+			if s.err != nil {
+				return nil, s.err
+			}
+			s.state = WHITESPACE
+			s.unread(c)
+			return tags, nil
+
 		case HCOMMENT:
 			// single line comment
 			if c == '\n' {
@@ -0,0 +1,226 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// A value that failed a rule of its field's validate tag, e.g.
+//   Port int `ucl:"port" validate:"required,min=1,max=65535"`
+//
+// Rules:
+//   required   the key must be set, or have a default, including within
+//              an absent section held as a struct value (not a pointer)
+//   min=n      numbers must be at least n, and strings, lists and objects
+//              have at least n elements
+//   max=n      likewise, at most n
+//   oneof=a b  the value must be one of those listed
+//   pattern=re strings must match the regular expression; as it may hold
+//              commas, it must be the last rule
+type ValidationError struct {
+	Path    string
+	Message string  // e.g. "must be at most 65535"
+	Origin  *Origin // where the value, or the object missing it, was set
+
+	where string // path of the value or object, to find Origin
+}
+
+func (e *ValidationError) Error() string {
+	return e.Path + " " + e.Message + e.Origin.at()
+}
+
+// All the values that failed validation
+type ValidationErrors []*ValidationError
+
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, ve := range e {
+		msgs[i] = ve.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Split rules, leaving a pattern whole
+func splitRules(rules string) []string {
+	var list []string
+	for rules != "" {
+		if strings.HasPrefix(rules, "pattern=") {
+			return append(list, rules)
+		}
+		i := strings.IndexByte(rules, ',')
+		if i < 0 {
+			return append(list, rules)
+		}
+		list = append(list, rules[:i])
+		rules = rules[i+1:]
+	}
+	return list
+}
+
+// Check v, the value decoded into f, if present, at path against f's rules,
+// adding any failures to d.invalid. Rules that cannot apply are an error.
+func (d *decoder) validate(f field, v reflect.Value, present bool,
+                           path, where string) error {
+	if f.rules == "" {
+		return nil
+	}
+	fail := func(format string, a ...interface{}) {
+		d.invalid = append(d.invalid, &ValidationError{
+			Path: path,
+			Message: fmt.Sprintf(format, a...),
+			where: where,
+		})
+	}
+
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			// null
+			present = false
+			break
+		}
+		v = v.Elem()
+	}
+
+	for _, rule := range splitRules(f.rules) {
+		name, arg := rule, ""
+		if i := strings.IndexByte(rule, '='); i >= 0 {
+			name, arg = rule[:i], rule[i+1:]
+		}
+
+		switch name {
+		case "required":
+			if !present {
+				fail("is required")
+			}
+			continue
+		case "min", "max", "oneof", "pattern":
+		default:
+			return fmt.Errorf("%s: unknown validation rule %q", path, rule)
+		}
+		if !present {
+			continue
+		}
+
+		switch name {
+		case "min", "max":
+			limit, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				return fmt.Errorf("%s: invalid %s", path, rule)
+			}
+			n, length, ok := measure(v)
+			if !ok {
+				return fmt.Errorf("%s: %s does not apply to %s", path, name,
+				                  v.Type())
+			}
+			what := "be"
+			if length {
+				what = "have a length of"
+			}
+			if name == "min" && n < limit {
+				fail("must %s at least %s", what, arg)
+			} else if name == "max" && n > limit {
+				fail("must %s at most %s", what, arg)
+			}
+		case "oneof":
+			s := fmt.Sprint(v.Interface())
+			found := false
+			for _, opt := range strings.Fields(arg) {
+				if s == opt {
+					found = true
+					break
+				}
+			}
+			if !found {
+				fail("must be one of %s", strings.Join(strings.Fields(arg), ", "))
+			}
+		case "pattern":
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return fmt.Errorf("%s: invalid pattern %q: %v", path, arg, err)
+			}
+			if v.Kind() != reflect.String {
+				return fmt.Errorf("%s: pattern does not apply to %s", path,
+				                  v.Type())
+			}
+			if !re.MatchString(v.String()) {
+				fail("must match %s", arg)
+			}
+		}
+	}
+	return nil
+}
+
+// Check the required fields within v, a struct value whose key is absent,
+// at path; where locates the object missing the key. Struct pointers are
+// left nil, so their sections are optional, and fields with a default are
+// taken as set.
+func (d *decoder) validateAbsent(v reflect.Value, path, where string) error {
+	if v.Kind() != reflect.Struct || v.Type() == regexType ||
+	   v.Type() == regexpType {
+		return nil
+	}
+	for _, f := range d.structFields(v) {
+		if _, ok := f.opts.Get("default"); ok {
+			continue
+		}
+		fpath := joinPath(path, f.name)
+		if err := d.validate(f, f.v, false, fpath, where); err != nil {
+			return err
+		}
+		if err := d.validateAbsent(f.v, fpath, where); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The number in v, or its length, for min and max
+func measure(v reflect.Value) (n float64, length bool, ok bool) {
+	if v.Type() == numberType {
+		f, err := Number(v.String()).Float64()
+		return f, false, err == nil
+	}
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), false, true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+	     reflect.Uint64, reflect.Uintptr:
+		return float64(v.Uint()), false, true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), false, true
+	case reflect.String, reflect.Slice, reflect.Map, reflect.Array:
+		return float64(v.Len()), true, true
+	}
+	return 0, false, false
+}
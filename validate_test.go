@@ -0,0 +1,153 @@
+/*
+ * Copyright (c) 2015 Leon Dang, Nahanni Systems Inc
+ * All rights reserved.
+ *
+ * Redistribution and use in source and binary forms, with or without
+ * modification, are permitted provided that the following conditions
+ * are met:
+ *
+ * 1. Redistributions of source code must retain the above copyright
+ *    notice, this list of conditions and the following disclaimer
+ *    in this position and unchanged.
+ * 2. Redistributions in binary form must reproduce the above copyright
+ *    notice, this list of conditions and the following disclaimer in the
+ *    documentation and/or other materials provided with the distribution.
+ *
+ * THIS SOFTWARE IS PROVIDED BY THE AUTHOR AND CONTRIBUTORS "AS IS" AND
+ * ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+ * IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE
+ * ARE DISCLAIMED. IN NO EVENT SHALL THE AUTHOR OR CONTRIBUTORS BE LIABLE
+ * FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+ * DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS
+ * OR SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION)
+ * HOWEVER CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT
+ * LIABILITY, OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY
+ * OUT OF THE USE OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF
+ * SUCH DAMAGE.
+ */
+
+package ucl
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	type server struct {
+		Host string   `ucl:"host" validate:"required,pattern=^[a-z]+(,[a-z]+)*$"`
+		Port int      `ucl:"port" validate:"min=1,max=65535"`
+		Tags []string `ucl:"tags" validate:"max=2"`
+	}
+	type config struct {
+		Level   string   `ucl:"level" validate:"oneof=debug info warn"`
+		Servers []server `ucl:"servers"`
+		Name    *string  `ucl:"name" validate:"required,min=3"`
+		Workers int      `ucl:"workers,default=4" validate:"required,max=8"`
+	}
+
+	s := `
+level = trace;
+servers {
+	host = "a,b";
+	port = 0;
+}
+servers {
+	host = "A";
+	port = 70000;
+	tags = [a, b, c];
+}
+servers {
+	port = 80;
+}
+name = ab;
+`
+	p := NewParserFlags(bytes.NewBufferString(s), ParseNumbers)
+	if _, err := p.Ucl(); err != nil {
+		t.Fatal(err)
+	}
+	var cfg config
+	_, err := p.Decode(&cfg, "ucl", 0)
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var msgs []string
+	for _, e := range errs {
+		msgs = append(msgs, e.Error())
+	}
+	expect := []string{
+		"level must be one of debug, info, warn at line 2",
+		"servers[0].port must be at least 1 at line 5",
+		"servers[1].host must match ^[a-z]+(,[a-z]+)*$ at line 8",
+		"servers[1].port must be at most 65535 at line 9",
+		"servers[1].tags must have a length of at most 2 at line 10",
+		"servers[2].host is required at line 12",
+		"name must have a length of at least 3 at line 15",
+	}
+	if !reflect.DeepEqual(msgs, expect) {
+		t.Errorf("got %q", msgs)
+	}
+	// the values are decoded all the same
+	if cfg.Level != "trace" || len(cfg.Servers) != 3 || cfg.Workers != 4 {
+		t.Errorf("got %+v", cfg)
+	}
+
+	valid := "level = info; servers { host = x; port = 1; } name = abc;"
+	if err := Decode(parseString(t, valid), &cfg, "ucl"); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	err = Decode(parseString(t, "servers { port = 1; }"), &cfg, "ucl")
+	if err == nil || err.Error() != "servers[0].host is required; " +
+	                                 "name is required" {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// a section given once keeps its line, and an absent one is still
+	// checked for required fields, unless it is a pointer
+	type db struct {
+		Host string `ucl:"host" validate:"required"`
+		Port int    `ucl:"port,default=5432" validate:"required,max=100"`
+	}
+	var sections struct {
+		Backend []server `ucl:"backend"`
+		Opts    struct {
+			DB db `ucl:"db"`
+		} `ucl:"opts"`
+		Replica *db `ucl:"replica"`
+	}
+	p = NewParser(bytes.NewBufferString(
+	    "\nbackend {\n\thost = a;\n\tport = 70000;\n}\nopts {\n}\n"))
+	if _, err := p.Ucl(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = p.Decode(&sections, "ucl", 0)
+	expectErr := "backend[0].port must be at most 65535 at line 4; " +
+	             "opts.db.host is required at line 6"
+	if err == nil || err.Error() != expectErr {
+		t.Errorf("sections: unexpected error: %v", err)
+	}
+
+	type badMin struct {
+		On bool `ucl:"on" validate:"min=1"`
+	}
+	type badRule struct {
+		On bool `ucl:"on" validate:"positive"`
+	}
+	type badPattern struct {
+		S string `ucl:"s" validate:"pattern=a("`
+	}
+	errors := map[string] interface{}{
+		"on: min does not apply to bool": &badMin{},
+		`on: unknown validation rule "positive"`: &badRule{},
+		"s: invalid pattern \"a(\": error parsing regexp: " +
+		"missing closing ): `a(`": &badPattern{},
+	}
+	for expect, v := range errors {
+		err := Decode(parseString(t, "on = true; s = a;"), v, "ucl")
+		if err == nil || err.Error() != expect {
+			t.Errorf("%T: unexpected error: %v", v, err)
+		}
+	}
+}